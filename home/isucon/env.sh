@@ -6,3 +6,13 @@ ISUCON_DB_NAME="isuride"
 
 # マッチング間隔（秒）
 ISUCON_MATCHING_INTERVAL=0.5
+
+# 署名付きトークンで認証する場合（鍵は kid:secret をカンマ区切りで指定し、署名に使う鍵IDを選ぶ）
+# ISUCON_TOKEN_MODE="signed"
+# ISUCON_TOKEN_KEYS="k1:change-me"
+# ISUCON_TOKEN_KEY_ID="k1"
+
+# レート制限（1秒あたりのリクエスト数,バースト）。未設定なら既定値を使う
+# ISUCON_RATE_LIMIT_SIGNUP="5,20"
+# ISUCON_RATE_LIMIT_APP="10,30"
+# ISUCON_RATE_LIMIT_CHAIR="20,30"
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -40,7 +41,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
+	session := newSession("user", userID, userSessionTTL)
 	invitationCode := secureRandomStr(15)
 
 	tx, err := db.Beginx()
@@ -53,7 +54,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	_, err = tx.ExecContext(
 		ctx,
 		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
+		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, session.Token, invitationCode,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -119,16 +120,25 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	user := &User{}
+	if err := tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := insertSession(ctx, tx, session); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	UpdateUser(user)
+	StoreSession(session)
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "app_session",
-		Value: accessToken,
-	})
+	setSessionCookie(w, r, "app_session", session)
 
 	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
 		ID:             userID,
@@ -152,7 +162,10 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := ctx.Value("user").(*User)
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	_, err := db.ExecContext(
 		ctx,
@@ -192,7 +205,10 @@ type getAppRidesResponseItemChair struct {
 
 func appGetRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	user := ctx.Value("user").(*User)
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -223,7 +239,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, ride.Pooled)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -243,7 +259,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 
 		chair := &Chair{}
 		if ride.ChairID.Valid {
-			chair = GetChair(ride.ChairID.String)
+			chair = chairRepository.Get(ride.ChairID.String)
 		}
 		item.Chair.ID = chair.ID
 		item.Chair.Name = chair.Name
@@ -269,9 +285,15 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// 1ライドに指定できる経由地の最大数
+const maxRideWaypoints = 5
+
 type appPostRidesRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	ScheduledAt           *int64       `json:"scheduled_at"`
+	Pooled                bool         `json:"pooled"`
 }
 
 type appPostRidesResponse struct {
@@ -292,6 +314,84 @@ func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (
 	return status, nil
 }
 
+// ライドの経由地を経由順に取得する
+func getRideWaypoints(ctx context.Context, q sqlx.QueryerContext, rideID string) ([]RideWaypoint, error) {
+	waypoints := []RideWaypoint{}
+	if err := sqlx.SelectContext(ctx, q, &waypoints, `SELECT * FROM ride_waypoints WHERE ride_id = ? ORDER BY seq`, rideID); err != nil {
+		return nil, err
+	}
+	return waypoints, nil
+}
+
+// 複数ライドの経由地をまとめて取得する
+func getRideWaypointsByRideIDs(ctx context.Context, q sqlx.QueryerContext, rideIDs []string) (map[string][]RideWaypoint, error) {
+	waypointsByRideID := make(map[string][]RideWaypoint, len(rideIDs))
+	if len(rideIDs) == 0 {
+		return waypointsByRideID, nil
+	}
+	query, args, err := sqlx.In(`SELECT * FROM ride_waypoints WHERE ride_id IN (?) ORDER BY ride_id, seq`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	waypoints := []RideWaypoint{}
+	if err := sqlx.SelectContext(ctx, q, &waypoints, query, args...); err != nil {
+		return nil, err
+	}
+	for _, waypoint := range waypoints {
+		waypointsByRideID[waypoint.RideID] = append(waypointsByRideID[waypoint.RideID], waypoint)
+	}
+	return waypointsByRideID, nil
+}
+
+type poolItineraryStop struct {
+	RideID     string     `json:"ride_id"`
+	Kind       string     `json:"kind"`
+	Coordinate Coordinate `json:"coordinate"`
+	Completed  bool       `json:"completed"`
+}
+
+// 相乗りの行程に含まれるライドを取得する
+func getPoolRides(ctx context.Context, tx *sqlx.Tx, poolID string) ([]Ride, error) {
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE pool_id = ? ORDER BY created_at`, poolID); err != nil {
+		return nil, err
+	}
+	return rides, nil
+}
+
+// 相乗りの行程を、全員の乗車地を回ってから各目的地を回る順に組み立てる
+func buildPoolItinerary(ctx context.Context, tx *sqlx.Tx, rides []Ride) ([]poolItineraryStop, error) {
+	pickups := make([]poolItineraryStop, 0, len(rides))
+	destinations := make([]poolItineraryStop, 0, len(rides))
+	for _, ride := range rides {
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			return nil, err
+		}
+		pickups = append(pickups, poolItineraryStop{
+			RideID:     ride.ID,
+			Kind:       "pickup",
+			Coordinate: Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			Completed:  status != "MATCHING" && status != "ENROUTE",
+		})
+		destinations = append(destinations, poolItineraryStop{
+			RideID:     ride.ID,
+			Kind:       "destination",
+			Coordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			Completed:  status == "ARRIVED" || status == "COMPLETED",
+		})
+	}
+	return append(pickups, destinations...), nil
+}
+
+func waypointCoordinates(waypoints []RideWaypoint) []Coordinate {
+	coordinates := make([]Coordinate, 0, len(waypoints))
+	for _, waypoint := range waypoints {
+		coordinates = append(coordinates, Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude})
+	}
+	return coordinates
+}
+
 func appPostRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesRequest{}
@@ -303,8 +403,31 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if len(req.Waypoints) > maxRideWaypoints {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("waypoints must be at most %d", maxRideWaypoints))
+		return
+	}
+
+	// 相乗りライドの行程は乗車地と目的地だけから組み立てる
+	if req.Pooled && (len(req.Waypoints) > 0 || req.ScheduledAt != nil) {
+		writeError(w, http.StatusBadRequest, errors.New("pooled rides cannot have waypoints or scheduled_at"))
+		return
+	}
 
-	user := ctx.Value("user").(*User)
+	var scheduledAt *time.Time
+	if req.ScheduledAt != nil {
+		t := time.UnixMilli(*req.ScheduledAt)
+		if !t.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("scheduled_at must be in the future"))
+			return
+		}
+		scheduledAt = &t
+	}
+
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 	rideID := ulid.Make().String()
 
 	tx, err := db.Beginx()
@@ -314,48 +437,63 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	rides := []Ride{}
-	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	continuingRideCount := 0
-	for _, ride := range rides {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
+	// 予約ライドは即時のライドと並行して持てるので、進行中のライドの確認は即時のライドだけ行う
+	if scheduledAt == nil {
+		rides := []Ride{}
+		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" {
-			continuingRideCount++
+
+		continuingRideCount := 0
+		for _, ride := range rides {
+			status, err := getLatestRideStatus(ctx, tx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if status != "COMPLETED" && status != "SCHEDULED" && status != "CANCELED" {
+				continuingRideCount++
+			}
 		}
-	}
 
-	if continuingRideCount > 0 {
-		writeError(w, http.StatusConflict, errors.New("ride already exists"))
-		return
+		if continuingRideCount > 0 {
+			writeError(w, http.StatusConflict, errors.New("ride already exists"))
+			return
+		}
 	}
 
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, scheduled_at, pooled)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, scheduledAt, req.Pooled,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	initialStatus := "MATCHING"
+	if scheduledAt != nil {
+		initialStatus = "SCHEDULED"
+	}
+	changes := &rideStatusChanges{}
+	if err := transitionRideStatus(ctx, tx, changes, rideID, initialStatus); err != nil {
+		writeRideStatusError(w, err)
 		return
 	}
 
+	for i, waypoint := range req.Waypoints {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO ride_waypoints (id, ride_id, seq, latitude, longitude) VALUES (?, ?, ?, ?, ?)`,
+			ulid.Make().String(), rideID, i+1, waypoint.Latitude, waypoint.Longitude,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
 	var rideCount int
 	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -422,7 +560,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, ride.Pooled)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -432,6 +570,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	changes.Publish()
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
 		RideID: rideID,
@@ -439,9 +578,145 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type appGetScheduledRidesResponse struct {
+	Rides []appGetScheduledRidesResponseItem `json:"rides"`
+}
+
+type appGetScheduledRidesResponseItem struct {
+	ID                    string       `json:"id"`
+	PickupCoordinate      Coordinate   `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate   `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	Fare                  int          `json:"fare"`
+	ScheduledAt           int64        `json:"scheduled_at"`
+	RequestedAt           int64        `json:"requested_at"`
+}
+
+func appGetScheduledRides(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	rides := []Ride{}
+	if err := tx.SelectContext(
+		ctx,
+		&rides,
+		`SELECT * FROM rides WHERE user_id = ? AND scheduled_at IS NOT NULL AND chair_id IS NULL ORDER BY scheduled_at`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := []appGetScheduledRidesResponseItem{}
+	for _, ride := range rides {
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if status != "SCHEDULED" {
+			continue
+		}
+
+		waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, ride.Pooled)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		items = append(items, appGetScheduledRidesResponseItem{
+			ID:                    ride.ID,
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			Waypoints:             waypointCoordinates(waypoints),
+			Fare:                  fare,
+			ScheduledAt:           ride.ScheduledAt.UnixMilli(),
+			RequestedAt:           ride.CreatedAt.UnixMilli(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &appGetScheduledRidesResponse{
+		Rides: items,
+	})
+}
+
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? AND user_id = ? FOR UPDATE`, rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 椅子の確保が始まった予約ライドはキャンセルできない
+	if ride.ScheduledAt == nil || ride.ChairID.Valid {
+		writeError(w, http.StatusConflict, errors.New("only scheduled rides can be canceled"))
+		return
+	}
+
+	changes := &rideStatusChanges{}
+	if err := transitionRideStatus(ctx, tx, changes, ride.ID, "CANCELED"); err != nil {
+		writeRideStatusError(w, err)
+		return
+	}
+
+	// 予約時に適用したクーポンは未使用に戻す
+	if _, err := tx.ExecContext(ctx, `UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	changes.Publish()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type appPostRidesEstimatedFareRequest struct {
-	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	PickupCoordinate      *Coordinate  `json:"pickup_coordinate"`
+	DestinationCoordinate *Coordinate  `json:"destination_coordinate"`
+	Waypoints             []Coordinate `json:"waypoints"`
+	Pooled                bool         `json:"pooled"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
@@ -460,8 +735,19 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if len(req.Waypoints) > maxRideWaypoints {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("waypoints must be at most %d", maxRideWaypoints))
+		return
+	}
+	if req.Pooled && len(req.Waypoints) > 0 {
+		writeError(w, http.StatusBadRequest, errors.New("pooled rides cannot have waypoints"))
+		return
+	}
 
-	user := ctx.Value("user").(*User)
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -470,7 +756,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, req.Pooled, req.Waypoints...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -483,7 +769,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
 		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Discount: calculatePooledFare(req.Pooled, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, req.Waypoints...) - discounted,
 	})
 }
 
@@ -491,6 +777,17 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 func calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
 	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
 }
+
+// 経由地を含めた各区間のマンハッタン距離の合計を求める
+func calculateRouteDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, waypoints []Coordinate) int {
+	distance := 0
+	prev := Coordinate{Latitude: pickupLatitude, Longitude: pickupLongitude}
+	for _, waypoint := range waypoints {
+		distance += calculateDistance(prev.Latitude, prev.Longitude, waypoint.Latitude, waypoint.Longitude)
+		prev = waypoint
+	}
+	return distance + calculateDistance(prev.Latitude, prev.Longitude, destLatitude, destLongitude)
+}
 func abs(a int) int {
 	if a < 0 {
 		return -a
@@ -499,7 +796,9 @@ func abs(a int) int {
 }
 
 type appPostRideEvaluationRequest struct {
-	Evaluation int `json:"evaluation"`
+	Evaluation int      `json:"evaluation"`
+	Tags       []string `json:"tags"`
+	Comment    string   `json:"comment"`
 }
 
 type appPostRideEvaluationResponse struct {
@@ -519,6 +818,15 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
 		return
 	}
+	tags, err := normalizeRideFeedbackTags(req.Tags)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateRideFeedbackComment(req.Comment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -527,8 +835,9 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	// 同じライドへの評価が同時に届いても、後から来た方は評価済みとして断る
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -536,21 +845,44 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if ride.Evaluation != nil {
+		writeError(w, http.StatusConflict, errRideAlreadyEvaluated)
+		return
+	}
+	// 到着済みのライドだけが評価によって完了に遷移できる
+	changes := &rideStatusChanges{}
+	if err := transitionRideStatus(ctx, tx, changes, ride.ID, "COMPLETED"); err != nil {
+		writeRideStatusError(w, err)
+		return
+	}
+
+	// 完了時の精算額を記録しておき、オーナーの売上の集計で運賃を計算し直さないようにする
+	sale, err := calculateRideSale(ctx, tx, ride)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, ride.Pooled)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chair := chairRepository.Get(ride.ChairID.String)
+	if chair == nil {
+		writeError(w, http.StatusInternalServerError, errors.New("chair of the ride not found"))
+		return
+	}
+	commissionRate, err := getCommissionRate(ctx, tx, chair.OwnerID, chair.Model)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	settlement := settleRide(sale, fare, commissionRate)
 
 	result, err := tx.ExecContext(
 		ctx,
-		`UPDATE rides SET evaluation = ? WHERE id = ?`,
-		req.Evaluation, rideID)
+		`UPDATE rides SET evaluation = ?, sale = ?, discount = ?, commission_rate = ?, commission = ?, payout = ?, completed_at = CURRENT_TIMESTAMP(6), owner_id = ?, model = ? WHERE id = ?`,
+		req.Evaluation, settlement.Sale, settlement.Discount, settlement.CommissionRate, settlement.Commission, settlement.Payout, chair.OwnerID, chair.Model, rideID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -562,12 +894,15 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, errors.New("ride not found"))
 		return
 	}
-
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
+	if err := recordSalesDaily(ctx, tx, rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordChairStats(ctx, tx, chair.ID, req.Evaluation); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordRideFeedback(ctx, tx, rideID, chair.ID, req.Evaluation, tags, req.Comment); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -591,11 +926,6 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
 		Amount: fare,
 	}
@@ -607,8 +937,9 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
+		// 予約のまま終わったライドやキャンセルされたライドは決済されていないので数えない
 		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
+		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? AND evaluation IS NOT NULL ORDER BY created_at ASC`, ride.UserID); err != nil {
 			return nil, err
 		}
 		return rides, nil
@@ -625,12 +956,39 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chairStatsCache.Add(chair.ID, req.Evaluation)
+	changes.Publish()
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
 		CompletedAt: ride.UpdatedAt.UnixMilli(),
 	})
 }
 
+// getNotificationRide
+// 通知するライドを選ぶ。椅子が割り当てられていない予約ライドは通知対象にしない
+// 進行中のライドと未送信の状態があるライドを優先して開始日時の早い順に、無ければ最後に開始したライドを返す
+func getNotificationRide(ctx context.Context, tx *sqlx.Tx, userID string) (*Ride, error) {
+	ride := &Ride{}
+	err := tx.GetContext(ctx, ride, `SELECT *
+FROM rides
+WHERE user_id = ?
+  AND (scheduled_at IS NULL OR chair_id IS NOT NULL)
+  AND ((evaluation IS NULL AND canceled_at IS NULL)
+    OR EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.app_sent_at IS NULL))
+ORDER BY COALESCE(scheduled_at, created_at) ASC
+LIMIT 1`, userID)
+	if err == nil {
+		return ride, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? AND (scheduled_at IS NULL OR chair_id IS NOT NULL) ORDER BY COALESCE(scheduled_at, created_at) DESC LIMIT 1`, userID); err != nil {
+		return nil, err
+	}
+	return ride, nil
+}
+
 type appGetNotificationResponseData struct {
 	RideID                string                           `json:"ride_id"`
 	PickupCoordinate      Coordinate                       `json:"pickup_coordinate"`
@@ -638,6 +996,7 @@ type appGetNotificationResponseData struct {
 	Fare                  int                              `json:"fare"`
 	Status                string                           `json:"status"`
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
+	Pool                  *appGetNotificationResponsePool  `json:"pool,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
 }
@@ -649,6 +1008,10 @@ type appGetNotificationResponseChair struct {
 	Stats appGetNotificationResponseChairStats `json:"stats"`
 }
 
+type appGetNotificationResponsePool struct {
+	Itinerary []poolItineraryStop `json:"itinerary"`
+}
+
 type appGetNotificationResponseChairStats struct {
 	TotalRidesCount    int     `json:"total_rides_count"`
 	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
@@ -656,7 +1019,10 @@ type appGetNotificationResponseChairStats struct {
 
 func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	user := ctx.Value("user").(*User)
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -682,8 +1048,8 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				}
 			}()
 
-			ride := &Ride{}
-			if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+			ride, err := getNotificationRide(ctx, tx, user.ID)
+			if err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
 					tx.Rollback()
 					tx = nil
@@ -715,7 +1081,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				status = yetSentRideStatus.Status
 			}
 
-			fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+			fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, ride.Pooled)
 			if err != nil {
 				writeError(w, http.StatusInternalServerError, err)
 				slog.Error("failed to calculate discounted fare", "error", err, "user_id", user.ID, "ride", ride)
@@ -739,20 +1105,31 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if ride.ChairID.Valid {
-				chair := GetChair(ride.ChairID.String)
-
-				stats, err := getChairStats(ctx, tx, chair.ID)
-				if err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					slog.Error("failed to get chair stats", "error", err, "chair_id", chair.ID)
-					return
-				}
+				chair := chairRepository.Get(ride.ChairID.String)
 
 				response.Chair = &appGetNotificationResponseChair{
 					ID:    chair.ID,
 					Name:  chair.Name,
 					Model: chair.Model,
-					Stats: stats,
+					Stats: getChairStats(chair.ID),
+				}
+			}
+
+			if ride.PoolID.Valid {
+				poolRides, err := getPoolRides(ctx, tx, ride.PoolID.String)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					slog.Error("failed to get pool rides", "error", err, "pool_id", ride.PoolID.String)
+					return
+				}
+				itinerary, err := buildPoolItinerary(ctx, tx, poolRides)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					slog.Error("failed to build pool itinerary", "error", err, "pool_id", ride.PoolID.String)
+					return
+				}
+				response.Pool = &appGetNotificationResponsePool{
+					Itinerary: itinerary,
 				}
 			}
 
@@ -783,68 +1160,11 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 				f.Flush()
 			}
 		case <-ctx.Done():
-			break
-		}
-	}
-}
-
-func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
-	stats := appGetNotificationResponseChairStats{}
-
-	rides := []Ride{}
-	err := tx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC`,
-		chairID,
-	)
-	if err != nil {
-		return stats, err
-	}
-
-	totalRideCount := 0
-	totalEvaluation := 0.0
-	for _, ride := range rides {
-		rideStatuses := []RideStatus{}
-		err = tx.SelectContext(
-			ctx,
-			&rideStatuses,
-			`SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`,
-			ride.ID,
-		)
-		if err != nil {
-			return stats, err
-		}
-
-		var arrivedAt, pickupedAt *time.Time
-		var isCompleted bool
-		for _, status := range rideStatuses {
-			if status.Status == "ARRIVED" {
-				arrivedAt = &status.CreatedAt
-			} else if status.Status == "CARRYING" {
-				pickupedAt = &status.CreatedAt
-			}
-			if status.Status == "COMPLETED" {
-				isCompleted = true
-			}
-		}
-		if arrivedAt == nil || pickupedAt == nil {
-			continue
-		}
-		if !isCompleted {
-			continue
+			return
+		case <-serverShuttingDown:
+			return
 		}
-
-		totalRideCount++
-		totalEvaluation += float64(*ride.Evaluation)
 	}
-
-	stats.TotalRidesCount = totalRideCount
-	if totalRideCount > 0 {
-		stats.TotalEvaluationAvg = totalEvaluation / float64(totalRideCount)
-	}
-
-	return stats, nil
 }
 
 type appGetNearbyChairsResponse struct {
@@ -955,12 +1275,16 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+// 相乗りライドは距離料金を割り引いた運賃を求める
+func calculatePooledFare(pooled bool, pickupLatitude, pickupLongitude, destLatitude, destLongitude int, waypoints ...Coordinate) int {
+	meteredFare := farePerDistance * calculateRouteDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude, waypoints)
+	if pooled {
+		meteredFare = meteredFare * pooledFareRate / 100
+	}
 	return initialFare + meteredFare
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int, pooled bool, waypoints ...Coordinate) (int, error) {
 	var coupon Coupon
 	discount := 0
 	if ride != nil {
@@ -968,6 +1292,13 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 		destLongitude = ride.DestinationLongitude
 		pickupLatitude = ride.PickupLatitude
 		pickupLongitude = ride.PickupLongitude
+		pooled = ride.Pooled
+
+		rideWaypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+		if err != nil {
+			return 0, err
+		}
+		waypoints = waypointCoordinates(rideWaypoints)
 
 		// すでにクーポンが紐づいているならそれの割引額を参照
 		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
@@ -997,8 +1328,14 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	return discountFare(calculatePooledFare(pooled, pickupLatitude, pickupLongitude, destLatitude, destLongitude, waypoints...), discount), nil
+}
+
+// discountFare
+// 割引は初乗り運賃を除いた距離料金にだけ適用する
+func discountFare(fare, discount int) int {
+	meteredFare := fare - initialFare
 	discountedMeteredFare := max(meteredFare-discount, 0)
 
-	return initialFare + discountedMeteredFare, nil
+	return initialFare + discountedMeteredFare
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// chair_locations から椅子ごとの総移動距離を計算し直す
+const recomputeChairTotalDistancesQuery = `
+SELECT chair_id,
+       COALESCE(SUM(ABS(latitude - prev_latitude) + ABS(longitude - prev_longitude)), 0) AS total_distance,
+       MAX(created_at) AS updated_at
+FROM (SELECT chair_id,
+             latitude,
+             longitude,
+             created_at,
+             LAG(latitude) OVER w  AS prev_latitude,
+             LAG(longitude) OVER w AS prev_longitude
+      FROM chair_locations
+      WINDOW w AS (PARTITION BY chair_id ORDER BY created_at, id)) AS chair_location_deltas
+GROUP BY chair_id
+`
+
+// loadChairLocations
+// chair_total_distances の総移動距離と、椅子ごとに直近 chairLocationHistorySize 件の位置情報をメモリに読み込む
+func loadChairLocations(ctx context.Context) error {
+	totals := []ChairTotalDistance{}
+	if err := db.SelectContext(ctx, &totals, "SELECT * FROM chair_total_distances"); err != nil {
+		return err
+	}
+	recentLocations := []ChairLocation{}
+	if err := db.SelectContext(ctx, &recentLocations, `
+SELECT id, chair_id, latitude, longitude, created_at
+FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY chair_id ORDER BY created_at DESC, id DESC) AS rn
+      FROM chair_locations) AS recent_chair_locations
+WHERE rn <= ?
+ORDER BY chair_id, created_at, id
+`, chairLocationHistorySize); err != nil {
+		return err
+	}
+
+	tracks := map[string]*chairLocationTrack{}
+	for _, cl := range recentLocations {
+		track, ok := tracks[cl.ChairID]
+		if !ok {
+			track = &chairLocationTrack{}
+			tracks[cl.ChairID] = track
+		}
+		track.latest = &cl
+		track.history.push(&cl)
+	}
+	for _, total := range totals {
+		track, ok := tracks[total.ChairID]
+		if !ok {
+			track = &chairLocationTrack{}
+			tracks[total.ChairID] = track
+		}
+		track.totalDistance = total.TotalDistance
+		track.totalDistanceUpdatedAt = total.UpdatedAt
+	}
+
+	ChairLocationMap.Clear()
+	for chairID, track := range tracks {
+		ChairLocationMap.Store(chairID, track)
+	}
+	return nil
+}
+
+type internalGetChairDistanceCheckResponse struct {
+	CheckedChairs int                                  `json:"checked_chairs"`
+	Drifts        []internalGetChairDistanceCheckDrift `json:"drifts"`
+}
+
+type internalGetChairDistanceCheckDrift struct {
+	ChairID    string `json:"chair_id"`
+	Memory     int    `json:"memory"`
+	Summary    int    `json:"summary"`
+	Recomputed int    `json:"recomputed"`
+}
+
+// 椅子ごとの総移動距離について、メモリ・chair_total_distances・chair_locations から計算し直した値を比べてずれを報告する
+// 書き込み待ちの位置情報は先に書き込むが、確認中に届いた位置情報の分はずれとして出ることがある
+func internalGetChairDistanceCheck(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := chairLocations.Flush(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	recomputed := []ChairTotalDistance{}
+	if err := db.SelectContext(ctx, &recomputed, recomputeChairTotalDistancesQuery); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	summaries := []ChairTotalDistance{}
+	if err := db.SelectContext(ctx, &summaries, "SELECT * FROM chair_total_distances"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	driftsByChairID := map[string]*internalGetChairDistanceCheckDrift{}
+	driftOf := func(chairID string) *internalGetChairDistanceCheckDrift {
+		d, ok := driftsByChairID[chairID]
+		if !ok {
+			d = &internalGetChairDistanceCheckDrift{ChairID: chairID}
+			driftsByChairID[chairID] = d
+		}
+		return d
+	}
+	for _, total := range recomputed {
+		driftOf(total.ChairID).Recomputed = total.TotalDistance
+	}
+	for _, total := range summaries {
+		driftOf(total.ChairID).Summary = total.TotalDistance
+	}
+	ChairLocationMap.Range(func(key, value any) bool {
+		totalDistance, _ := GetChairTotalDistance(key.(string))
+		driftOf(key.(string)).Memory = totalDistance
+		return true
+	})
+
+	res := internalGetChairDistanceCheckResponse{
+		CheckedChairs: len(driftsByChairID),
+		Drifts:        []internalGetChairDistanceCheckDrift{},
+	}
+	for _, d := range driftsByChairID {
+		if d.Memory == d.Recomputed && d.Summary == d.Recomputed {
+			continue
+		}
+		slog.Warn("chair total distance drifted",
+			"chair_id", d.ChairID,
+			"memory", d.Memory,
+			"summary", d.Summary,
+			"recomputed", d.Recomputed,
+		)
+		res.Drifts = append(res.Drifts, *d)
+	}
+	sort.Slice(res.Drifts, func(i, j int) bool {
+		return res.Drifts[i].ChairID < res.Drifts[j].ChairID
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
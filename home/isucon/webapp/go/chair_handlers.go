@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -35,49 +37,67 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
-			return
-		}
+	chairID := ulid.Make().String()
+	session := newSession("chair", chairID, chairSessionTTL)
+
+	tx, err := db.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	chairID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
+	defer tx.Rollback()
 
 	now := time.Now()
-	_, err := db.ExecContext(
+	registerToken, err := useChairRegisterToken(ctx, tx, req.ChairRegisterToken, now)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidChairRegisterToken):
+			writeError(w, http.StatusUnauthorized, err)
+		case errors.Is(err, errChairRegisterTokenExhausted):
+			writeError(w, http.StatusForbidden, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	ownerID := registerToken.OwnerID
+
+	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		chairID, owner.ID, req.Name, req.Model, false, accessToken, now, now,
+		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token, register_token_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chairID, ownerID, req.Name, req.Model, false, session.Token, registerToken.ID, now, now,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	UpdateChair(&Chair{
-		ID:          chairID,
-		OwnerID:     owner.ID,
-		Name:        req.Name,
-		Model:       req.Model,
-		IsActive:    false,
-		AccessToken: accessToken,
-		CreatedAt:   now,
-		UpdatedAt:   now,
-	}, &now)
-
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "chair_session",
-		Value: accessToken,
+	if err := insertSession(ctx, tx, session); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairRepository.Put(&Chair{
+		ID:              chairID,
+		OwnerID:         ownerID,
+		Name:            req.Name,
+		Model:           req.Model,
+		IsActive:        false,
+		AccessToken:     session.Token,
+		RegisterTokenID: sql.NullString{String: registerToken.ID, Valid: true},
+		CreatedAt:       now,
+		UpdatedAt:       now,
 	})
+	StoreSession(session)
+
+	setSessionCookie(w, r, "chair_session", session)
 
 	writeJSON(w, http.StatusCreated, &chairPostChairsResponse{
 		ID:      chairID,
-		OwnerID: owner.ID,
+		OwnerID: ownerID,
 	})
 }
 
@@ -87,7 +107,10 @@ type postChairActivityRequest struct {
 
 func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	chair := ctx.Value("chair").(*Chair)
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
 
 	req := &postChairActivityRequest{}
 	if err := bindJSON(r, req); err != nil {
@@ -95,13 +118,40 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	// 引退した椅子はアクティブに戻せない
+	result, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = ?, updated_at = ? WHERE id = ? AND retired_at IS NULL", req.IsActive, now, chair.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	chair.IsActive = req.IsActive
-	UpdateChair(chair, nil)
+	if affected, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if affected == 0 {
+		writeError(w, http.StatusConflict, errChairRetired)
+		return
+	}
+	if err := insertChairActivity(ctx, tx, chair.ID, req.IsActive, now); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairRepository.Update(chair.ID, func(c *Chair) {
+		c.IsActive = req.IsActive
+		c.UpdatedAt = now
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -118,7 +168,10 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chair := ctx.Value("chair").(*Chair)
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -127,58 +180,16 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	prevLocation := &ChairLocation{} // 一個前の座標
-	if err := tx.GetContext(ctx, prevLocation, `SELECT * FROM chair_locations WHERE chair_id = ? ORDER BY created_at DESC LIMIT 1`, chair.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		} else {
-			prevLocation = nil
-		}
-	}
-
-	chairLocationID := ulid.Make().String()
 	now := time.Now()
-	cl := ChairLocation{
-		ID:        chairLocationID,
-		ChairID:   chair.ID,
-		Latitude:  req.Latitude,
-		Longitude: req.Longitude,
-		CreatedAt: now,
-	}
-	InsertChairLocation(&cl)
-	go func() {
-		time.Sleep(90 * time.Second)
-		db.ExecContext(
-			ctx,
-			`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?)`,
-			chairLocationID, chair.ID, req.Latitude, req.Longitude, now,
-		)
-	}()
-	/*
-
-	 */
-
 	location := &ChairLocation{
-		ID:        chairLocationID,
+		ID:        ulid.Make().String(),
 		ChairID:   chair.ID,
 		Latitude:  req.Latitude,
 		Longitude: req.Longitude,
 		CreatedAt: now,
 	}
 
-	if prevLocation != nil {
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO chair_locations_minus_distance (id, chair_id, distance) VALUES (?, ?, ?)",
-			ulid.Make().String(), chair.ID, abs(prevLocation.Longitude-location.Longitude)+abs(prevLocation.Latitude-location.Latitude),
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	}
-
+	changes := &rideStatusChanges{}
 	ride := &Ride{}
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
@@ -186,24 +197,19 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
+		// 相乗りの場合は行程に含まれる全ライドの状態を進める
+		rides := []Ride{*ride}
+		if ride.PoolID.Valid {
+			rides, err = getPoolRides(ctx, tx, ride.PoolID.String)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
 			}
-
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
+		}
+		for i := range rides {
+			if err := advanceRideByCoordinate(ctx, tx, changes, &rides[i], req.Latitude, req.Longitude, now); err != nil {
+				writeRideStatusError(w, err)
+				return
 			}
 		}
 	}
@@ -212,12 +218,61 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	changes.Publish()
+
+	// 総移動距離はメモリで足し込み、位置情報と一緒に chair_total_distances へ書き込む
+	totalDistance := InsertChairLocation(location)
+	if err := chairLocations.Enqueue(ctx, location, totalDistance); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
 
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
 		RecordedAt: location.CreatedAt.UnixMilli(),
 	})
 }
 
+// 椅子が到着した座標に応じてライドの状態を進める
+func advanceRideByCoordinate(ctx context.Context, tx *sqlx.Tx, changes *rideStatusChanges, ride *Ride, latitude, longitude int, now time.Time) error {
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		return err
+	}
+	if status == "COMPLETED" || status == "CANCELED" {
+		return nil
+	}
+
+	if latitude == ride.PickupLatitude && longitude == ride.PickupLongitude && status == "ENROUTE" {
+		if err := transitionRideStatus(ctx, tx, changes, ride.ID, "PICKUP"); err != nil {
+			return err
+		}
+	}
+
+	if status == "CARRYING" || status == "WAYPOINT" {
+		waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+		if err != nil {
+			return err
+		}
+		// 未到着の経由地が残っている間は目的地に到着したとみなさない
+		nextWaypoint := nextRideWaypoint(waypoints)
+		if nextWaypoint != nil {
+			if latitude == nextWaypoint.Latitude && longitude == nextWaypoint.Longitude {
+				if _, err := tx.ExecContext(ctx, "UPDATE ride_waypoints SET arrived_at = ? WHERE id = ?", now, nextWaypoint.ID); err != nil {
+					return err
+				}
+				if err := transitionRideStatus(ctx, tx, changes, ride.ID, "WAYPOINT"); err != nil {
+					return err
+				}
+			}
+		} else if latitude == ride.DestinationLatitude && longitude == ride.DestinationLongitude {
+			if err := transitionRideStatus(ctx, tx, changes, ride.ID, "ARRIVED"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type simpleUser struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
@@ -229,16 +284,45 @@ type chairGetNotificationResponse struct {
 }
 
 type chairGetNotificationResponseData struct {
-	RideID                string     `json:"ride_id"`
-	User                  simpleUser `json:"user"`
-	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
-	DestinationCoordinate Coordinate `json:"destination_coordinate"`
-	Status                string     `json:"status"`
+	RideID                string              `json:"ride_id"`
+	User                  simpleUser          `json:"user"`
+	PickupCoordinate      Coordinate          `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate          `json:"destination_coordinate"`
+	NextStopCoordinate    *Coordinate         `json:"next_stop_coordinate,omitempty"`
+	Itinerary             []poolItineraryStop `json:"itinerary,omitempty"`
+	Status                string              `json:"status"`
+}
+
+// 未到着の経由地のうち最初のものを返す
+func nextRideWaypoint(waypoints []RideWaypoint) *RideWaypoint {
+	for i := range waypoints {
+		if waypoints[i].ArrivedAt == nil {
+			return &waypoints[i]
+		}
+	}
+	return nil
+}
+
+// 椅子が次に向かうべき地点を返す
+func nextStopCoordinate(ride *Ride, status string, waypoints []RideWaypoint) *Coordinate {
+	switch status {
+	case "MATCHING", "ENROUTE":
+		return &Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}
+	case "PICKUP", "CARRYING", "WAYPOINT":
+		if waypoint := nextRideWaypoint(waypoints); waypoint != nil {
+			return &Coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude}
+		}
+		return &Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}
+	}
+	return nil
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	chair := ctx.Value("chair").(*Chair)
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -277,7 +361,26 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
+			// 相乗りの場合は行程に含まれる全ライドのステータスを順に通知する
+			poolRides := []Ride{*ride}
+			if ride.PoolID.Valid {
+				poolRides, err = getPoolRides(ctx, tx, ride.PoolID.String)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					slog.Error("failed to get pool rides", "error", err, "pool_id", ride.PoolID.String)
+					return
+				}
+			}
+			poolRideIDs := make([]string, 0, len(poolRides))
+			for _, poolRide := range poolRides {
+				poolRideIDs = append(poolRideIDs, poolRide.ID)
+			}
+			query, args, err := sqlx.In(`SELECT * FROM ride_statuses WHERE ride_id IN (?) AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, poolRideIDs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := tx.GetContext(ctx, &yetSentRideStatus, query, args...); err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
 					slog.Info("no ride_status", "ride_id", ride.ID)
 					status, err = getLatestRideStatus(ctx, tx, ride.ID)
@@ -293,6 +396,11 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				}
 			} else {
 				status = yetSentRideStatus.Status
+				for i := range poolRides {
+					if poolRides[i].ID == yetSentRideStatus.RideID {
+						ride = &poolRides[i]
+					}
+				}
 			}
 
 			user := &User{}
@@ -303,6 +411,23 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			waypoints, err := getRideWaypoints(ctx, tx, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				slog.Error("failed to get ride waypoints", "error", err, "ride_id", ride.ID)
+				return
+			}
+
+			var itinerary []poolItineraryStop
+			if ride.PoolID.Valid {
+				itinerary, err = buildPoolItinerary(ctx, tx, poolRides)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					slog.Error("failed to build pool itinerary", "error", err, "pool_id", ride.PoolID.String)
+					return
+				}
+			}
+
 			if yetSentRideStatus.ID != "" {
 				_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
 				if err != nil {
@@ -332,7 +457,16 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 					Latitude:  ride.DestinationLatitude,
 					Longitude: ride.DestinationLongitude,
 				},
-				Status: status,
+				NextStopCoordinate: nextStopCoordinate(ride, status, waypoints),
+				Itinerary:          itinerary,
+				Status:             status,
+			}
+			// 相乗りの場合は行程上の未到達の最初の地点へ向かう
+			for _, stop := range itinerary {
+				if !stop.Completed {
+					response.NextStopCoordinate = &Coordinate{Latitude: stop.Coordinate.Latitude, Longitude: stop.Coordinate.Longitude}
+					break
+				}
 			}
 
 			w.Write([]byte("data: "))
@@ -346,7 +480,9 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 				f.Flush()
 			}
 		case <-ctx.Done():
-			break
+			return
+		case <-serverShuttingDown:
+			return
 		}
 	}
 }
@@ -359,7 +495,10 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	rideID := r.PathValue("ride_id")
 
-	chair := ctx.Value("chair").(*Chair)
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
 
 	req := &postChairRidesRideIDStatusRequest{}
 	if err := bindJSON(r, req); err != nil {
@@ -385,40 +524,27 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if ride.ChairID.String != chair.ID {
-		writeError(w, http.StatusBadRequest, errors.New("not assigned to this ride"))
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
 		return
 	}
 
-	switch req.Status {
-	// Acknowledge the ride
-	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
-			return
-		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	default:
+	// 椅子から送れるのは ENROUTE(Acknowledge the ride) と CARRYING(After Picking up user) だけ
+	if req.Status != "ENROUTE" && req.Status != "CARRYING" {
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
+
+	changes := &rideStatusChanges{}
+	if err := transitionRideStatus(ctx, tx, changes, ride.ID, req.Status); err != nil {
+		writeRideStatusError(w, err)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	changes.Publish()
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,31 @@
+package main
+
+// 椅子ごとにメモリに残す直近の位置情報の件数。それより古いものは chair_locations から引く
+const chairLocationHistorySize = 32
+
+// chairLocationHistory
+// 直近 chairLocationHistorySize 件の位置情報を持つリングバッファ。一杯になったら最も古いものを上書きする
+type chairLocationHistory struct {
+	buf  [chairLocationHistorySize]*ChairLocation
+	next int
+	size int
+}
+
+func (h *chairLocationHistory) push(cl *ChairLocation) {
+	h.buf[h.next] = cl
+	h.next = (h.next + 1) % len(h.buf)
+	if h.size < len(h.buf) {
+		h.size++
+	}
+}
+
+// list
+// 古い順に並べた複製を返す
+func (h *chairLocationHistory) list() []*ChairLocation {
+	locations := make([]*ChairLocation, 0, h.size)
+	start := (h.next - h.size + len(h.buf)) % len(h.buf)
+	for i := 0; i < h.size; i++ {
+		locations = append(locations, h.buf[(start+i)%len(h.buf)])
+	}
+	return locations
+}
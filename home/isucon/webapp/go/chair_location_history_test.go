@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestChairLocation(chairID string, i int) *ChairLocation {
+	return &ChairLocation{
+		ID:        fmt.Sprintf("%s-%03d", chairID, i),
+		ChairID:   chairID,
+		Latitude:  i,
+		Longitude: i,
+		CreatedAt: time.Unix(int64(i), 0),
+	}
+}
+
+func TestChairLocationHistory(t *testing.T) {
+	tests := []struct {
+		name      string
+		pushed    int
+		wantFirst int
+	}{
+		{name: "empty", pushed: 0},
+		{name: "partially filled", pushed: 5, wantFirst: 0},
+		{name: "exactly full", pushed: chairLocationHistorySize, wantFirst: 0},
+		{name: "one evicted", pushed: chairLocationHistorySize + 1, wantFirst: 1},
+		{name: "wrapped more than once", pushed: chairLocationHistorySize*2 + 3, wantFirst: chairLocationHistorySize + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := chairLocationHistory{}
+			for i := 0; i < tt.pushed; i++ {
+				h.push(newTestChairLocation("chair", i))
+			}
+			got := h.list()
+			wantLen := min(tt.pushed, chairLocationHistorySize)
+			if len(got) != wantLen {
+				t.Fatalf("len = %d, want %d", len(got), wantLen)
+			}
+			// 古いものから追い出され、残りは古い順に並ぶ
+			for i, cl := range got {
+				if cl.Latitude != tt.wantFirst+i {
+					t.Fatalf("got[%d] = %d, want %d", i, cl.Latitude, tt.wantFirst+i)
+				}
+			}
+		})
+	}
+}
+
+func TestListRecentChairLocations(t *testing.T) {
+	chairID := "chair-location-history-test"
+	t.Cleanup(func() { ChairLocationMap.Delete(chairID) })
+
+	for i := 0; i < chairLocationHistorySize+10; i++ {
+		InsertChairLocation(newTestChairLocation(chairID, i))
+	}
+	got := ListRecentChairLocations(chairID)
+	if len(got) != chairLocationHistorySize {
+		t.Fatalf("len = %d, want %d", len(got), chairLocationHistorySize)
+	}
+	if got[0].Latitude != 10 || got[len(got)-1].Latitude != chairLocationHistorySize+9 {
+		t.Fatalf("unexpected range: %d..%d", got[0].Latitude, got[len(got)-1].Latitude)
+	}
+	if latest := GetChairLocation(chairID); latest != got[len(got)-1] {
+		t.Fatalf("latest location %+v is not the newest in history", latest)
+	}
+	if got := ListRecentChairLocations("missing"); got != nil {
+		t.Fatalf("unexpected history for a missing chair: %v", got)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 書き込み待ちにできる位置情報の上限。溢れたらリクエスト側を待たせる
+	chairLocationQueueSize = 10000
+	// 書き込めずに手元に溜めておける位置情報の上限。超えたらキューから取り出すのをやめ、Enqueue を待たせる
+	chairLocationPendingLimit = 50000
+	// 1回の INSERT でまとめて書き込む行数
+	chairLocationBatchSize = 500
+	// バッチが埋まらなくても書き込む間隔
+	chairLocationFlushInterval = 200 * time.Millisecond
+	// 1回の書き込みの期限。MySQL が応答しなくても受け付けを止め続けないようにする
+	chairLocationWriteTimeout = 5 * time.Second
+	// 書き込みに失敗したときの再試行の待ち時間の初期値と上限
+	chairLocationRetryMinBackoff = 100 * time.Millisecond
+	chairLocationRetryMaxBackoff = 5 * time.Second
+)
+
+var errChairLocationWriterClosed = errors.New("chair location writer is closed")
+
+// chairLocationWrite
+// 書き込み待ちの位置情報と、その位置まで移動したときの総移動距離
+type chairLocationWrite struct {
+	location      *ChairLocation
+	totalDistance int
+}
+
+// chairLocationWriter
+// chair_locations と chair_total_distances への書き込みを遅延させてまとめて行う
+// 失敗したバッチは捨てずに手元に残し、受け付けを止めないまま間隔を空けて再試行する
+type chairLocationWriter struct {
+	queue    chan chairLocationWrite
+	flushReq chan chan error
+	stop     chan context.Context
+	done     chan struct{}
+	closed   atomic.Bool
+	// バッチを1つのトランザクションで書き込む。テストでは差し替える
+	writeBatch func(ctx context.Context, batch []chairLocationWrite) error
+
+	pending atomic.Int64
+	written atomic.Int64
+	retried atomic.Int64
+	lost    atomic.Int64
+}
+
+var chairLocations *chairLocationWriter
+
+func newChairLocationWriter() *chairLocationWriter {
+	cw := &chairLocationWriter{
+		queue:      make(chan chairLocationWrite, chairLocationQueueSize),
+		flushReq:   make(chan chan error),
+		stop:       make(chan context.Context, 1),
+		done:       make(chan struct{}),
+		writeBatch: writeChairLocations,
+	}
+	go cw.run()
+	return cw
+}
+
+// publishChairLocationWriterVars
+// /debug/vars で書き込み待ちの件数などを見られるようにする
+func publishChairLocationWriterVars() {
+	expvar.Publish("chair_location_writer", expvar.Func(func() any {
+		cw := chairLocations
+		if cw == nil {
+			return nil
+		}
+		return map[string]int64{
+			"queue_depth":    int64(len(cw.queue)),
+			"queue_capacity": int64(cap(cw.queue)),
+			"pending":        cw.pending.Load(),
+			"written":        cw.written.Load(),
+			"retried":        cw.retried.Load(),
+			"lost":           cw.lost.Load(),
+		}
+	}))
+}
+
+// Enqueue
+// 位置情報を書き込み待ちに積む。キューが一杯なら空くか ctx が終わるまで待つ
+func (cw *chairLocationWriter) Enqueue(ctx context.Context, cl *ChairLocation, totalDistance int) error {
+	if cw.closed.Load() {
+		return errChairLocationWriterClosed
+	}
+	select {
+	case cw.queue <- chairLocationWrite{location: cl, totalDistance: totalDistance}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush
+// 書き込み待ちの位置情報をすべて書き込むまで待つ。書き込めるまで再試行を続けるので、待つ時間は ctx で区切る
+func (cw *chairLocationWriter) Flush(ctx context.Context) error {
+	errc := make(chan error, 1)
+	select {
+	case cw.flushReq <- errc:
+	case <-cw.done:
+		return errChairLocationWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close
+// 新しい書き込みを受け付けなくし、残りを書き込み終えるまで待ってから停止する。HTTP サーバーを止めた後に呼ぶ
+// ctx が終わるまでに書き込めなかった分は諦め、その件数をエラーで返す
+func (cw *chairLocationWriter) Close(ctx context.Context) error {
+	if cw.closed.Swap(true) {
+		return errChairLocationWriterClosed
+	}
+	cw.stop <- ctx
+	<-cw.done
+	if lost := cw.lost.Load(); lost > 0 {
+		return fmt.Errorf("lost %d chair locations: %w", lost, ctx.Err())
+	}
+	return nil
+}
+
+func (cw *chairLocationWriter) run() {
+	defer close(cw.done)
+
+	ticker := time.NewTicker(chairLocationFlushInterval)
+	defer ticker.Stop()
+	retry := time.NewTimer(0)
+	retry.Stop()
+	backoff := chairLocationRetryMinBackoff
+	retrying := false
+
+	var pending []chairLocationWrite
+	var waiters []chan error
+	for {
+		// 書き込めずに溜まりすぎたらキューから取り出すのをやめ、Enqueue を待たせる
+		queue := cw.queue
+		if len(pending) >= chairLocationPendingLimit {
+			queue = nil
+		}
+
+		write := false
+		select {
+		case item := <-queue:
+			pending = append(pending, item)
+			write = len(pending) >= chairLocationBatchSize
+		case <-ticker.C:
+			write = len(pending) > 0
+		case <-retry.C:
+			retrying = false
+			write = true
+		case errc := <-cw.flushReq:
+			pending = cw.drainQueue(pending)
+			waiters = append(waiters, errc)
+			write = true
+		case ctx := <-cw.stop:
+			cw.shutdown(ctx, cw.drainQueue(pending), waiters)
+			return
+		}
+
+		// 再試行を待っている間も受け付けは続け、溜まった分は次の再試行でまとめて書き込む
+		if write && !retrying {
+			var err error
+			if pending, err = cw.writePending(context.Background(), pending); err != nil {
+				slog.Warn("failed to write chair locations, retrying", "pending", len(pending), "backoff", backoff, "error", err)
+				retry.Reset(backoff)
+				retrying = true
+				backoff = min(backoff*2, chairLocationRetryMaxBackoff)
+			} else {
+				backoff = chairLocationRetryMinBackoff
+			}
+		}
+		cw.pending.Store(int64(len(pending)))
+
+		if len(pending) == 0 {
+			for _, errc := range waiters {
+				errc <- nil
+			}
+			waiters = nil
+		}
+	}
+}
+
+// drainQueue
+// キューに溜まっている分を待たずに取り出して pending の後ろに積む
+func (cw *chairLocationWriter) drainQueue(pending []chairLocationWrite) []chairLocationWrite {
+	for {
+		select {
+		case item := <-cw.queue:
+			pending = append(pending, item)
+		default:
+			return pending
+		}
+	}
+}
+
+// writePending
+// 書き込み待ちを先頭からバッチに分けて書き込む。失敗したらそのバッチ以降を残して返す
+func (cw *chairLocationWriter) writePending(ctx context.Context, pending []chairLocationWrite) ([]chairLocationWrite, error) {
+	for len(pending) > 0 {
+		n := min(len(pending), chairLocationBatchSize)
+		writeCtx, cancel := context.WithTimeout(ctx, chairLocationWriteTimeout)
+		err := cw.writeBatch(writeCtx, pending[:n])
+		cancel()
+		if err != nil {
+			cw.retried.Add(1)
+			return pending, err
+		}
+		cw.written.Add(int64(n))
+		pending = pending[n:]
+	}
+	return nil, nil
+}
+
+// shutdown
+// 停止時に残りをその場で書き込む。ctx が終わるまで再試行を続け、それでも書き込めなかった分は件数をログと lost に残す
+func (cw *chairLocationWriter) shutdown(ctx context.Context, pending []chairLocationWrite, waiters []chan error) {
+	backoff := chairLocationRetryMinBackoff
+	var err error
+	for {
+		if pending, err = cw.writePending(ctx, pending); err == nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff = min(backoff*2, chairLocationRetryMaxBackoff)
+			continue
+		case <-ctx.Done():
+		}
+		cw.lost.Add(int64(len(pending)))
+		slog.Error("gave up writing chair locations on shutdown", "count", len(pending), "error", err)
+		err = fmt.Errorf("lost %d chair locations: %w", len(pending), err)
+		break
+	}
+	cw.pending.Store(int64(len(pending)))
+
+	for _, errc := range waiters {
+		errc <- err
+	}
+}
+
+// writeChairLocations
+// 位置情報と椅子ごとの総移動距離を1つのトランザクションで書き込む
+func writeChairLocations(ctx context.Context, batch []chairLocationWrite) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertChairLocations(ctx, tx, batch); err != nil {
+		return err
+	}
+	if err := upsertChairTotalDistances(ctx, tx, batch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertChairLocations
+// 複数行の INSERT でまとめて書き込む。書き込めたか分からないまま再試行しても重複しないように既存の行は無視する
+func insertChairLocations(ctx context.Context, tx *sqlx.Tx, batch []chairLocationWrite) error {
+	query := "INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES " +
+		strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?), ", len(batch)), ", ") +
+		" ON DUPLICATE KEY UPDATE id = id"
+	args := make([]any, 0, len(batch)*5)
+	for _, item := range batch {
+		cl := item.location
+		args = append(args, cl.ID, cl.ChairID, cl.Latitude, cl.Longitude, cl.CreatedAt)
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// upsertChairTotalDistances
+// バッチ内で椅子ごとに最も進んだ総移動距離を書き込む。総移動距離は減らないので、古い値で上書きしないように大きい方を残す
+func upsertChairTotalDistances(ctx context.Context, tx *sqlx.Tx, batch []chairLocationWrite) error {
+	latest := map[string]chairLocationWrite{}
+	for _, item := range batch {
+		chairID := item.location.ChairID
+		if prev, ok := latest[chairID]; !ok || item.totalDistance >= prev.totalDistance {
+			latest[chairID] = item
+		}
+	}
+
+	query := "INSERT INTO chair_total_distances (chair_id, total_distance, updated_at) VALUES " +
+		strings.TrimSuffix(strings.Repeat("(?, ?, ?), ", len(latest)), ", ") +
+		" ON DUPLICATE KEY UPDATE updated_at = IF(VALUES(total_distance) >= total_distance, VALUES(updated_at), updated_at)," +
+		" total_distance = GREATEST(total_distance, VALUES(total_distance))"
+	args := make([]any, 0, len(latest)*3)
+	for chairID, item := range latest {
+		args = append(args, chairID, item.totalDistance, item.location.CreatedAt)
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeChairLocationStore
+// failing の間は書き込みに失敗し、書き込めた位置情報の ID を順に記録する
+type fakeChairLocationStore struct {
+	failing atomic.Bool
+	mu      sync.Mutex
+	ids     []string
+}
+
+func (s *fakeChairLocationStore) write(ctx context.Context, batch []chairLocationWrite) error {
+	if s.failing.Load() {
+		return errors.New("database is down")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range batch {
+		s.ids = append(s.ids, item.location.ID)
+	}
+	return nil
+}
+
+func (s *fakeChairLocationStore) written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.ids)
+}
+
+func newTestChairLocationWriter(store *fakeChairLocationStore) *chairLocationWriter {
+	cw := &chairLocationWriter{
+		queue:      make(chan chairLocationWrite, chairLocationQueueSize),
+		flushReq:   make(chan chan error),
+		stop:       make(chan context.Context, 1),
+		done:       make(chan struct{}),
+		writeBatch: store.write,
+	}
+	go cw.run()
+	return cw
+}
+
+func enqueueTestLocation(t *testing.T, cw *chairLocationWriter, id string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cw.Enqueue(ctx, &ChairLocation{ID: id, ChairID: "chair1"}, 0); err != nil {
+		t.Fatalf("enqueue %s: %v", id, err)
+	}
+}
+
+func TestChairLocationWriterKeepsFailedBatches(t *testing.T) {
+	store := &fakeChairLocationStore{}
+	store.failing.Store(true)
+	cw := newTestChairLocationWriter(store)
+
+	enqueueTestLocation(t, cw, "loc1")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := cw.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("flush must keep waiting while writes fail, got %v", err)
+	}
+	// 再試行を待っている間も受け付けは止まらない
+	enqueueTestLocation(t, cw, "loc2")
+
+	store.failing.Store(false)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cw.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := store.written(); !slices.Equal(got, []string{"loc1", "loc2"}) {
+		t.Fatalf("unexpected written locations: %v", got)
+	}
+	if cw.retried.Load() == 0 || cw.lost.Load() != 0 || cw.pending.Load() != 0 {
+		t.Fatalf("unexpected counters: retried=%d lost=%d pending=%d", cw.retried.Load(), cw.lost.Load(), cw.pending.Load())
+	}
+
+	if err := cw.Close(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChairLocationWriterClose(t *testing.T) {
+	t.Run("writes the rest before stopping", func(t *testing.T) {
+		store := &fakeChairLocationStore{}
+		cw := newTestChairLocationWriter(store)
+		enqueueTestLocation(t, cw, "loc1")
+		enqueueTestLocation(t, cw, "loc2")
+
+		if err := cw.Close(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := store.written(); !slices.Equal(got, []string{"loc1", "loc2"}) {
+			t.Fatalf("unexpected written locations: %v", got)
+		}
+		if err := cw.Enqueue(context.Background(), &ChairLocation{ID: "loc3"}, 0); !errors.Is(err, errChairLocationWriterClosed) {
+			t.Fatalf("enqueue after close must fail, got %v", err)
+		}
+	})
+
+	t.Run("counts what could not be written", func(t *testing.T) {
+		store := &fakeChairLocationStore{}
+		store.failing.Store(true)
+		cw := newTestChairLocationWriter(store)
+		enqueueTestLocation(t, cw, "loc1")
+		enqueueTestLocation(t, cw, "loc2")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		if err := cw.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the deadline to be reported, got %v", err)
+		}
+		if cw.lost.Load() != 2 {
+			t.Fatalf("lost = %d, want 2", cw.lost.Load())
+		}
+	})
+}
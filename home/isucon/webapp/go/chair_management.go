@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errChairRetired        = errors.New("chair is retired")
+	errChairRideInProgress = errors.New("chair has a ride in progress")
+)
+
+// chairManagementError
+// 椅子の変更を断るときのステータスコードとエラー
+type chairManagementError struct {
+	statusCode int
+	err        error
+}
+
+func (e *chairManagementError) Error() string {
+	return e.err.Error()
+}
+
+func (e *chairManagementError) Unwrap() error {
+	return e.err
+}
+
+// manageOwnerChair
+// オーナーの椅子を行ロックしてから fn で変更し、コミット後にメモリの椅子を差し替える
+// 引退済みの椅子と、評価が終わっていないライドがある椅子は変更できない
+func manageOwnerChair(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, tx *sqlx.Tx, chair *Chair, now time.Time) error) (*Chair, bool) {
+	ctx := r.Context()
+	// 自分の椅子であることは ownerChairMiddleware で確認済み
+	current, ok := requireChair(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	defer tx.Rollback()
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", current.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return nil, false
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	// 行ロックを取るまでに別のリクエストで譲渡されているかもしれない
+	if chair.OwnerID != current.OwnerID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return nil, false
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusConflict, errChairRetired)
+		return nil, false
+	}
+
+	var inProgress int
+	if err := tx.GetContext(ctx, &inProgress, "SELECT COUNT(*) FROM rides WHERE chair_id = ? AND evaluation IS NULL FOR SHARE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if inProgress > 0 {
+		writeError(w, http.StatusConflict, errChairRideInProgress)
+		return nil, false
+	}
+
+	now := time.Now()
+	wasActive := chair.IsActive
+	if err := fn(ctx, tx, chair, now); err != nil {
+		var mErr *chairManagementError
+		if errors.As(err, &mErr) {
+			writeError(w, mErr.statusCode, mErr.err)
+			return nil, false
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	chair.UpdatedAt = now
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET owner_id = ?, name = ?, model = ?, is_active = ?, retired_at = ?, updated_at = ? WHERE id = ?",
+		chair.OwnerID, chair.Name, chair.Model, chair.IsActive, chair.RetiredAt, chair.UpdatedAt, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if chair.IsActive != wasActive {
+		if err := insertChairActivity(ctx, tx, chair.ID, chair.IsActive, now); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return nil, false
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	chairRepository.Put(chair)
+
+	return chair, true
+}
+
+type ownerPatchChairRequest struct {
+	Name  *string `json:"name"`
+	Model *string `json:"model"`
+}
+
+// 椅子の名前とモデルを変更する
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == nil && req.Model == nil {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(name, model) are empty"))
+		return
+	}
+	if (req.Name != nil && *req.Name == "") || (req.Model != nil && *req.Model == "") {
+		writeError(w, http.StatusBadRequest, errors.New("name and model must not be empty"))
+		return
+	}
+
+	chair, ok := manageOwnerChair(w, r, func(ctx context.Context, tx *sqlx.Tx, chair *Chair, now time.Time) error {
+		if req.Name != nil {
+			chair.Name = *req.Name
+		}
+		if req.Model != nil {
+			chair.Model = *req.Model
+		}
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerGetChairResponseChair(chair))
+}
+
+// 椅子を強制的に非アクティブにする。椅子は後で自分でアクティブに戻せる
+func ownerPostChairDeactivate(w http.ResponseWriter, r *http.Request) {
+	chair, ok := manageOwnerChair(w, r, func(ctx context.Context, tx *sqlx.Tx, chair *Chair, now time.Time) error {
+		chair.IsActive = false
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerGetChairResponseChair(chair))
+}
+
+// 椅子を引退させる。ライドや位置情報の履歴は残したまま、以降は配車されず認証もできなくなる
+func ownerPostChairRetire(w http.ResponseWriter, r *http.Request) {
+	revocations := &tokenRevocations{}
+	chair, ok := manageOwnerChair(w, r, func(ctx context.Context, tx *sqlx.Tx, chair *Chair, now time.Time) error {
+		chair.IsActive = false
+		chair.RetiredAt = &now
+		return deletePrincipalSessions(ctx, tx, revocations, string(RoleChair), chair.ID)
+	})
+	if !ok {
+		return
+	}
+	revocations.Apply()
+	InvalidatePrincipalSessions(string(RoleChair), chair.ID)
+
+	writeJSON(w, http.StatusOK, newOwnerGetChairResponseChair(chair))
+}
+
+type ownerPostChairTransferRequest struct {
+	OwnerID string `json:"owner_id"`
+}
+
+// 椅子を別のオーナーに譲渡する
+// ライドには完了したときのオーナーとモデルを記録しているので、譲渡前の売上は元のオーナーの売上と書き出しに残る
+func ownerPostChairTransfer(w http.ResponseWriter, r *http.Request) {
+	req := &ownerPostChairTransferRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.OwnerID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("some of required fields(owner_id) are empty"))
+		return
+	}
+
+	chair, ok := manageOwnerChair(w, r, func(ctx context.Context, tx *sqlx.Tx, chair *Chair, now time.Time) error {
+		if req.OwnerID == chair.OwnerID {
+			return &chairManagementError{statusCode: http.StatusBadRequest, err: errors.New("chair is already owned by the owner")}
+		}
+		var exists int
+		if err := tx.GetContext(ctx, &exists, "SELECT COUNT(*) FROM owners WHERE id = ?", req.OwnerID); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return &chairManagementError{statusCode: http.StatusNotFound, err: errors.New("owner not found")}
+		}
+		chair.OwnerID = req.OwnerID
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerGetChairResponseChair(chair))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 椅子の成績の元データをメモリに持っておく時間。ライドの状態が変わっても最大この時間だけ古い値を返す
+const chairPerformanceCacheTTL = 10 * time.Second
+
+// chairRideTimeline
+// ライド1件の状態ごとの遷移日時。その状態を通っていなければ nil
+type chairRideTimeline struct {
+	RideID      string     `db:"ride_id"`
+	OwnerID     *string    `db:"owner_id"`
+	Evaluation  *int       `db:"evaluation"`
+	CompletedAt *time.Time `db:"completed_at"`
+	AssignedAt  *time.Time `db:"assigned_at"`
+	EnrouteAt   *time.Time `db:"enroute_at"`
+	PickupAt    *time.Time `db:"pickup_at"`
+	CarryingAt  *time.Time `db:"carrying_at"`
+	ArrivedAt   *time.Time `db:"arrived_at"`
+	CanceledAt  *time.Time `db:"canceled_at"`
+	salesBreakdown
+}
+
+// insertChairActivity
+// 椅子のアクティブ状態の変更を記録し、成績のキャッシュを捨てる
+func insertChairActivity(ctx context.Context, tx *sqlx.Tx, chairID string, isActive bool, at time.Time) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO chair_activities (id, chair_id, is_active, created_at) VALUES (?, ?, ?, ?)", ulid.Make().String(), chairID, isActive, at); err != nil {
+		return err
+	}
+	chairPerformanceCache.Delete(chairID)
+	return nil
+}
+
+type chairPerformanceSource struct {
+	loadedAt   time.Time
+	rides      []chairRideTimeline
+	activities []ChairActivity
+}
+
+var chairPerformanceCache = sync.Map{}
+
+// loadChairPerformanceSource
+// 椅子のライドの遷移日時とアクティブ状態の履歴を読む。chairPerformanceCacheTTL の間はキャッシュを返す
+func loadChairPerformanceSource(ctx context.Context, chairID string) (*chairPerformanceSource, error) {
+	if v, ok := chairPerformanceCache.Load(chairID); ok {
+		source := v.(*chairPerformanceSource)
+		if time.Since(source.loadedAt) < chairPerformanceCacheTTL {
+			return source, nil
+		}
+	}
+
+	source := &chairPerformanceSource{loadedAt: time.Now()}
+	if err := db.SelectContext(ctx, &source.rides, `SELECT rides.id                                                            AS ride_id,
+       rides.owner_id,
+       rides.evaluation,
+       rides.completed_at,
+       rides.assigned_at,
+       COALESCE(rides.sale, 0)                                             AS sales,
+       COALESCE(rides.discount, 0)                                         AS discount,
+       COALESCE(rides.commission, 0)                                       AS commission,
+       COALESCE(rides.payout, 0)                                           AS payout,
+       MIN(CASE WHEN ride_statuses.status = 'ENROUTE' THEN ride_statuses.created_at END)  AS enroute_at,
+       MIN(CASE WHEN ride_statuses.status = 'PICKUP' THEN ride_statuses.created_at END)   AS pickup_at,
+       MIN(CASE WHEN ride_statuses.status = 'CARRYING' THEN ride_statuses.created_at END) AS carrying_at,
+       MIN(CASE WHEN ride_statuses.status = 'ARRIVED' THEN ride_statuses.created_at END)  AS arrived_at,
+       MIN(CASE WHEN ride_statuses.status = 'CANCELED' THEN ride_statuses.created_at END) AS canceled_at
+FROM rides
+         JOIN ride_statuses ON ride_statuses.ride_id = rides.id
+WHERE rides.chair_id = ?
+GROUP BY rides.id, rides.owner_id, rides.evaluation, rides.completed_at, rides.assigned_at, rides.sale, rides.discount, rides.commission, rides.payout`, chairID); err != nil {
+		return nil, err
+	}
+	if err := db.SelectContext(ctx, &source.activities, "SELECT * FROM chair_activities WHERE chair_id = ? ORDER BY created_at, id", chairID); err != nil {
+		return nil, err
+	}
+
+	chairPerformanceCache.Store(chairID, source)
+	return source, nil
+}
+
+// overlap
+// [start, end) と [since, until) が重なっている時間
+func overlap(start, end, since, until time.Time) time.Duration {
+	if start.Before(since) {
+		start = since
+	}
+	if end.After(until) {
+		end = until
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// durationAverage
+// 区間の長さの平均をミリ秒で持つ。1件も無ければ null を返す
+type durationAverage struct {
+	total time.Duration
+	count int
+}
+
+func (a *durationAverage) add(from, to *time.Time) {
+	if from == nil || to == nil {
+		return
+	}
+	a.total += to.Sub(*from)
+	a.count++
+}
+
+func (a *durationAverage) millis() *int64 {
+	if a.count == 0 {
+		return nil
+	}
+	ms := (a.total / time.Duration(a.count)).Milliseconds()
+	return &ms
+}
+
+type ownerGetChairStatsResponse struct {
+	ChairID string `json:"chair_id"`
+	Since   int64  `json:"since"`
+	Until   int64  `json:"until"`
+	// アクティブだった時間と、そのうちライドに割り当てられていた時間
+	ActiveTime  int64   `json:"active_time"`
+	BusyTime    int64   `json:"busy_time"`
+	Utilization float64 `json:"utilization"`
+	// 椅子が割り当てられてから迎車を始めるまでの時間
+	AvgAcceptanceLatency *int64 `json:"avg_acceptance_latency"`
+	// 迎車を始めてから乗車地に着くまでの時間
+	AvgPickupTime *int64 `json:"avg_pickup_time"`
+	// 乗車してから目的地に着くまでの時間
+	AvgTripDuration *int64         `json:"avg_trip_duration"`
+	CompletedRides  int            `json:"completed_rides"`
+	CanceledRides   int            `json:"canceled_rides"`
+	Ratings         chairRatings   `json:"ratings"`
+	Revenue         salesBreakdown `json:"revenue"`
+}
+
+// chairRatings
+// 評価の件数と平均。distribution は評価 1〜5 それぞれの件数
+type chairRatings struct {
+	Count        int     `json:"count"`
+	Average      float64 `json:"average"`
+	Distribution [5]int  `json:"distribution"`
+}
+
+// オーナーの椅子の成績。期間は since と until(ミリ秒)で指定し、省略すると椅子の登録から現在まで
+// 迎車・乗車などの時間は迎車を始めた日時が、評価と売上は完了日時が期間内のライドで集計する
+// 売上はこのオーナーの椅子として完了したライドの分だけを数える
+func ownerGetChairStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// 自分の椅子であることは ownerChairMiddleware で確認済み
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	since, until := chair.CreatedAt, now
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if r.URL.Query().Get("until") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = time.UnixMilli(parsed)
+	}
+	if until.Before(since) {
+		writeError(w, http.StatusBadRequest, errors.New("until must not be before since"))
+		return
+	}
+
+	source, err := loadChairPerformanceSource(ctx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairStatsResponse{
+		ChairID: chair.ID,
+		Since:   since.UnixMilli(),
+		Until:   until.UnixMilli(),
+	}
+
+	// 最初の記録より前は非アクティブだったものとして扱う
+	var activeTime time.Duration
+	var activeSince *time.Time
+	for _, activity := range source.activities {
+		switch {
+		case activity.IsActive && activeSince == nil:
+			at := activity.CreatedAt
+			activeSince = &at
+		case !activity.IsActive && activeSince != nil:
+			activeTime += overlap(*activeSince, activity.CreatedAt, since, until)
+			activeSince = nil
+		}
+	}
+	if activeSince != nil {
+		activeTime += overlap(*activeSince, now, since, until)
+	}
+
+	var busyTime time.Duration
+	var acceptance, pickup, trip durationAverage
+	var evaluationTotal int
+	for _, ride := range source.rides {
+		if ride.EnrouteAt != nil {
+			end := now
+			if ride.ArrivedAt != nil {
+				end = *ride.ArrivedAt
+			} else if ride.CanceledAt != nil {
+				end = *ride.CanceledAt
+			}
+			busyTime += overlap(*ride.EnrouteAt, end, since, until)
+
+			if !ride.EnrouteAt.Before(since) && ride.EnrouteAt.Before(until) {
+				acceptance.add(ride.AssignedAt, ride.EnrouteAt)
+				pickup.add(ride.EnrouteAt, ride.PickupAt)
+				trip.add(ride.CarryingAt, ride.ArrivedAt)
+				if ride.CanceledAt != nil {
+					res.CanceledRides++
+				}
+			}
+		}
+
+		if ride.CompletedAt == nil || ride.CompletedAt.Before(since) || !ride.CompletedAt.Before(until) {
+			continue
+		}
+		res.CompletedRides++
+		// 譲渡前に完了したライドの売上は元のオーナーのもの
+		if ride.OwnerID != nil && *ride.OwnerID == chair.OwnerID {
+			res.Revenue.add(ride.salesBreakdown)
+		}
+		if ride.Evaluation != nil && *ride.Evaluation >= 1 && *ride.Evaluation <= 5 {
+			res.Ratings.Count++
+			res.Ratings.Distribution[*ride.Evaluation-1]++
+			evaluationTotal += *ride.Evaluation
+		}
+	}
+
+	res.ActiveTime = activeTime.Milliseconds()
+	res.BusyTime = busyTime.Milliseconds()
+	if activeTime > 0 {
+		res.Utilization = min(float64(busyTime)/float64(activeTime), 1)
+	}
+	res.AvgAcceptanceLatency = acceptance.millis()
+	res.AvgPickupTime = pickup.millis()
+	res.AvgTripDuration = trip.millis()
+	if res.Ratings.Count > 0 {
+		res.Ratings.Average = float64(evaluationTotal) / float64(res.Ratings.Count)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
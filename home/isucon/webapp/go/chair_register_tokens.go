@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	errInvalidChairRegisterToken   = errors.New("invalid chair_register_token")
+	errChairRegisterTokenExhausted = errors.New("chair_register_token has reached max_chairs")
+)
+
+func newChairRegisterToken(ownerID string, expiresAt *time.Time, maxChairs *int) *ChairRegisterToken {
+	return &ChairRegisterToken{
+		ID:        ulid.Make().String(),
+		OwnerID:   ownerID,
+		Token:     secureRandomStr(32),
+		ExpiresAt: expiresAt,
+		MaxChairs: maxChairs,
+		CreatedAt: time.Now(),
+	}
+}
+
+func insertChairRegisterToken(ctx context.Context, tx *sqlx.Tx, t *ChairRegisterToken) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO chair_register_tokens (id, owner_id, token, expires_at, max_chairs, registered_chairs, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		t.ID, t.OwnerID, t.Token, t.ExpiresAt, t.MaxChairs, t.RegisteredChairs, t.CreatedAt,
+	)
+	return err
+}
+
+// useChairRegisterToken
+// 椅子の登録に使うトークンを行ロックして検証し、登録した椅子の数を1つ増やす
+// 同じトークンでの登録は行ロックで直列になるので max_chairs を超えて登録されることはない
+func useChairRegisterToken(ctx context.Context, tx *sqlx.Tx, token string, now time.Time) (*ChairRegisterToken, error) {
+	t := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, t, "SELECT * FROM chair_register_tokens WHERE token = ? FOR UPDATE", token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errInvalidChairRegisterToken
+		}
+		return nil, err
+	}
+	if t.RevokedAt != nil || (t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)) {
+		return nil, errInvalidChairRegisterToken
+	}
+	if t.MaxChairs != nil && t.RegisteredChairs >= *t.MaxChairs {
+		return nil, errChairRegisterTokenExhausted
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair_register_tokens SET registered_chairs = registered_chairs + 1 WHERE id = ?", t.ID); err != nil {
+		return nil, err
+	}
+	t.RegisteredChairs++
+	return t, nil
+}
+
+type ownerChairRegisterTokenResponse struct {
+	ID               string `json:"id"`
+	Token            string `json:"token"`
+	ExpiresAt        *int64 `json:"expires_at,omitempty"`
+	MaxChairs        *int   `json:"max_chairs,omitempty"`
+	RegisteredChairs int    `json:"registered_chairs"`
+	RevokedAt        *int64 `json:"revoked_at,omitempty"`
+	CreatedAt        int64  `json:"created_at"`
+}
+
+func newOwnerChairRegisterTokenResponse(t *ChairRegisterToken) ownerChairRegisterTokenResponse {
+	res := ownerChairRegisterTokenResponse{
+		ID:               t.ID,
+		Token:            t.Token,
+		MaxChairs:        t.MaxChairs,
+		RegisteredChairs: t.RegisteredChairs,
+		CreatedAt:        t.CreatedAt.UnixMilli(),
+	}
+	if t.ExpiresAt != nil {
+		expiresAt := t.ExpiresAt.UnixMilli()
+		res.ExpiresAt = &expiresAt
+	}
+	if t.RevokedAt != nil {
+		revokedAt := t.RevokedAt.UnixMilli()
+		res.RevokedAt = &revokedAt
+	}
+	return res
+}
+
+type ownerGetChairRegisterTokensResponse struct {
+	Tokens []ownerChairRegisterTokenResponse `json:"tokens"`
+}
+
+// オーナーの椅子登録トークンを失効したものも含めて新しい順に返す
+func ownerGetChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tokens := []ChairRegisterToken{}
+	if err := db.SelectContext(ctx, &tokens, "SELECT * FROM chair_register_tokens WHERE owner_id = ? ORDER BY created_at DESC, id DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairRegisterTokensResponse{Tokens: make([]ownerChairRegisterTokenResponse, 0, len(tokens))}
+	for i := range tokens {
+		res.Tokens = append(res.Tokens, newOwnerChairRegisterTokenResponse(&tokens[i]))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPostChairRegisterTokenRequest struct {
+	ExpiresAt *int64 `json:"expires_at"`
+	MaxChairs *int   `json:"max_chairs"`
+}
+
+// 椅子登録トークンを発行する。有効期限と登録できる椅子の数は省略すると無制限になる
+func ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	req := &ownerPostChairRegisterTokenRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := time.UnixMilli(*req.ExpiresAt)
+		if !t.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
+		}
+		expiresAt = &t
+	}
+	if req.MaxChairs != nil && *req.MaxChairs <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_chairs must be positive"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	t := newChairRegisterToken(owner.ID, expiresAt, req.MaxChairs)
+	if err := insertChairRegisterToken(ctx, tx, t); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerChairRegisterTokenResponse(t))
+}
+
+// lockOwnerChairRegisterToken
+// パスの token_id のトークンを行ロックして取得する。他のオーナーのトークンは存在しないものとして扱う
+func lockOwnerChairRegisterToken(w http.ResponseWriter, r *http.Request, tx *sqlx.Tx) (*ChairRegisterToken, bool) {
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	t := &ChairRegisterToken{}
+	if err := tx.GetContext(r.Context(), t, "SELECT * FROM chair_register_tokens WHERE id = ? AND owner_id = ? FOR UPDATE", r.PathValue("token_id"), owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair_register_token not found"))
+			return nil, false
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// 椅子登録トークンを失効させる。登録済みの椅子はそのまま使える
+func ownerPostChairRegisterTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	t, ok := lockOwnerChairRegisterToken(w, r, tx)
+	if !ok {
+		return
+	}
+	if t.RevokedAt == nil {
+		now := time.Now()
+		if _, err := tx.ExecContext(ctx, "UPDATE chair_register_tokens SET revoked_at = ? WHERE id = ?", now, t.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		t.RevokedAt = &now
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerChairRegisterTokenResponse(t))
+}
+
+// 椅子登録トークンを失効させ、同じ有効期限で新しいトークンを発行する
+// 登録できる椅子の数は古いトークンの残りを引き継ぐ。残りが無ければ 409 を返す
+func ownerPostChairRegisterTokenRotate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	old, ok := lockOwnerChairRegisterToken(w, r, tx)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if old.RevokedAt != nil || (old.ExpiresAt != nil && !now.Before(*old.ExpiresAt)) {
+		writeError(w, http.StatusConflict, errors.New("chair_register_token is already revoked or expired"))
+		return
+	}
+	// 上限に達したトークンを引き継いでも椅子を登録できないトークンにしかならない
+	var maxChairs *int
+	if old.MaxChairs != nil {
+		remaining := *old.MaxChairs - old.RegisteredChairs
+		if remaining <= 0 {
+			writeError(w, http.StatusConflict, errChairRegisterTokenExhausted)
+			return
+		}
+		maxChairs = &remaining
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chair_register_tokens SET revoked_at = ? WHERE id = ?", now, old.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	t := newChairRegisterToken(old.OwnerID, old.ExpiresAt, maxChairs)
+	if err := insertChairRegisterToken(ctx, tx, t); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerChairRegisterTokenResponse(t))
+}
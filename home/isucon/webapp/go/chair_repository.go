@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// chairIndex
+// ID・アクセストークン・オーナーごとの椅子の索引。一度公開した索引と *Chair は書き換えず、変更するときは複製を作って差し替える
+type chairIndex struct {
+	version       uint64
+	byID          map[string]*Chair
+	byAccessToken map[string]*Chair
+	byOwner       map[string]map[string]*Chair
+}
+
+func newChairIndex(size int) *chairIndex {
+	return &chairIndex{
+		byID:          make(map[string]*Chair, size),
+		byAccessToken: make(map[string]*Chair, size),
+		byOwner:       map[string]map[string]*Chair{},
+	}
+}
+
+// clone
+// 次の版の索引を作る。オーナーごとの索引は変更するときに put と remove で複製する
+func (idx *chairIndex) clone() *chairIndex {
+	next := &chairIndex{
+		version:       idx.version + 1,
+		byID:          make(map[string]*Chair, len(idx.byID)+1),
+		byAccessToken: make(map[string]*Chair, len(idx.byAccessToken)+1),
+		byOwner:       make(map[string]map[string]*Chair, len(idx.byOwner)+1),
+	}
+	for id, chair := range idx.byID {
+		next.byID[id] = chair
+	}
+	for token, chair := range idx.byAccessToken {
+		next.byAccessToken[token] = chair
+	}
+	for ownerID, owned := range idx.byOwner {
+		next.byOwner[ownerID] = owned
+	}
+	return next
+}
+
+// put
+// 複製した索引にだけ使う。椅子には索引の版を付ける
+func (idx *chairIndex) put(chair *Chair) {
+	idx.remove(chair.ID)
+	chair.Version = idx.version
+	idx.byID[chair.ID] = chair
+	if chair.AccessToken != "" {
+		idx.byAccessToken[chair.AccessToken] = chair
+	}
+	owned := make(map[string]*Chair, len(idx.byOwner[chair.OwnerID])+1)
+	for id, c := range idx.byOwner[chair.OwnerID] {
+		owned[id] = c
+	}
+	owned[chair.ID] = chair
+	idx.byOwner[chair.OwnerID] = owned
+}
+
+func (idx *chairIndex) remove(chairID string) {
+	prev, ok := idx.byID[chairID]
+	if !ok {
+		return
+	}
+	delete(idx.byID, chairID)
+	if idx.byAccessToken[prev.AccessToken] == prev {
+		delete(idx.byAccessToken, prev.AccessToken)
+	}
+	owned := make(map[string]*Chair, len(idx.byOwner[prev.OwnerID]))
+	for id, c := range idx.byOwner[prev.OwnerID] {
+		if id != chairID {
+			owned[id] = c
+		}
+	}
+	if len(owned) == 0 {
+		delete(idx.byOwner, prev.OwnerID)
+	} else {
+		idx.byOwner[prev.OwnerID] = owned
+	}
+}
+
+// ChairRepository
+// 椅子のメモリキャッシュ。読み出しはロックを取らずに今の版の索引を引き、変更は次の版の索引を作って差し替える
+// 取得したときは複製を返すので、呼び出し側で書き換えても他のリクエストには影響しない
+type ChairRepository struct {
+	// 変更どうしを直列にする
+	mu    sync.Mutex
+	index atomic.Pointer[chairIndex]
+}
+
+func NewChairRepository() *ChairRepository {
+	r := &ChairRepository{}
+	r.index.Store(newChairIndex(0))
+	return r
+}
+
+func snapshotChair(chair *Chair) *Chair {
+	if chair == nil {
+		return nil
+	}
+	c := *chair
+	return &c
+}
+
+// Get
+// IDをキーにして椅子を取得する
+func (r *ChairRepository) Get(id string) *Chair {
+	return snapshotChair(r.index.Load().byID[id])
+}
+
+// GetByAccessToken
+// アクセストークンをキーにして椅子を取得する
+func (r *ChairRepository) GetByAccessToken(token string) *Chair {
+	return snapshotChair(r.index.Load().byAccessToken[token])
+}
+
+// ListByOwner
+// オーナーの椅子を ID 順に取得する
+func (r *ChairRepository) ListByOwner(ownerID string) []*Chair {
+	owned := r.index.Load().byOwner[ownerID]
+	chairs := make([]*Chair, 0, len(owned))
+	for _, chair := range owned {
+		chairs = append(chairs, snapshotChair(chair))
+	}
+	sort.Slice(chairs, func(i, j int) bool {
+		return chairs[i].ID < chairs[j].ID
+	})
+	return chairs
+}
+
+// Version
+// 今の索引の版。変更するたびに増える
+func (r *ChairRepository) Version() uint64 {
+	return r.index.Load().version
+}
+
+// IsCurrent
+// 取得した椅子がその後に変更されていなければ true を返す
+func (r *ChairRepository) IsCurrent(chair *Chair) bool {
+	current, ok := r.index.Load().byID[chair.ID]
+	return ok && current.Version == chair.Version
+}
+
+// Put
+// 椅子を追加または置き換える。渡した値は複製して保持する
+func (r *ChairRepository) Put(chair *Chair) {
+	c := snapshotChair(chair)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.index.Load().clone()
+	index.put(c)
+	r.index.Store(index)
+}
+
+// Update
+// 椅子の複製に fn を適用して差し替え、更新後の複製を返す。椅子が無ければ nil を返す
+func (r *ChairRepository) Update(id string, fn func(chair *Chair)) *Chair {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := snapshotChair(r.index.Load().byID[id])
+	if c == nil {
+		return nil
+	}
+	fn(c)
+	index := r.index.Load().clone()
+	index.put(c)
+	r.index.Store(index)
+	return snapshotChair(c)
+}
+
+// Reload
+// 索引を作り直してまとめて差し替える。作り直している間も読み出しは古い索引で続けられる
+func (r *ChairRepository) Reload(chairs []Chair) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := newChairIndex(len(chairs))
+	index.version = r.index.Load().version + 1
+	// 公開前の索引なのでオーナーごとの索引も複製せずに直接書き込む
+	for i := range chairs {
+		c := snapshotChair(&chairs[i])
+		c.Version = index.version
+		index.byID[c.ID] = c
+		if c.AccessToken != "" {
+			index.byAccessToken[c.AccessToken] = c
+		}
+		if index.byOwner[c.OwnerID] == nil {
+			index.byOwner[c.OwnerID] = map[string]*Chair{}
+		}
+		index.byOwner[c.OwnerID][c.ID] = c
+	}
+	r.index.Store(index)
+}
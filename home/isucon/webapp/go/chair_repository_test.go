@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestChairs() []Chair {
+	now := time.Now()
+	return []Chair{
+		{ID: "chair1", OwnerID: "owner1", Name: "a", Model: "m", AccessToken: "token1", CreatedAt: now, UpdatedAt: now},
+		{ID: "chair2", OwnerID: "owner1", Name: "b", Model: "m", AccessToken: "token2", CreatedAt: now, UpdatedAt: now},
+		{ID: "chair3", OwnerID: "owner2", Name: "c", Model: "m", AccessToken: "token3", CreatedAt: now, UpdatedAt: now},
+	}
+}
+
+// sync.Map の頃に競合していたアクセスを再現する。go test -race で検出されないこと
+// chairPostActivity は取得した *Chair の IsActive をその場で書き換えていて、その間も通知や一覧が同じ *Chair を読んでいた
+// 取得した椅子を書き換えるゴルーチンと、同じ椅子を ID・トークン・オーナーから読むゴルーチンを同時に動かす
+func TestChairRepositoryConcurrentActivity(t *testing.T) {
+	repo := NewChairRepository()
+	repo.Reload(newTestChairs())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(4)
+		// 取得した椅子をその場で書き換える。以前は他のゴルーチンと同じ *Chair だった
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				for _, chair := range []*Chair{repo.Get("chair1"), repo.GetByAccessToken("token1"), repo.ListByOwner("owner1")[0]} {
+					chair.IsActive = !chair.IsActive
+					chair.Name = "mutated"
+					chair.UpdatedAt = time.Now()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if chair := repo.Get("chair1"); chair != nil {
+					_ = chair.IsActive
+					_ = chair.Name
+				}
+				if chair := repo.GetByAccessToken("token1"); chair != nil {
+					_ = chair.IsActive
+				}
+				for _, chair := range repo.ListByOwner("owner1") {
+					_ = chair.IsActive
+					_ = chair.UpdatedAt
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				repo.Update("chair1", func(c *Chair) {
+					c.IsActive = !c.IsActive
+					c.UpdatedAt = time.Now()
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				repo.Reload(newTestChairs())
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, chair := range []*Chair{repo.Get("chair1"), repo.GetByAccessToken("token1")} {
+		if chair == nil || chair.Name != "a" {
+			t.Fatalf("repository was modified through a returned chair: %+v", chair)
+		}
+	}
+}
+
+func TestChairRepositorySnapshot(t *testing.T) {
+	repo := NewChairRepository()
+	repo.Reload(newTestChairs())
+
+	chair := repo.Get("chair1")
+	chair.IsActive = true
+	chair.Name = "changed"
+	if got := repo.Get("chair1"); got.IsActive || got.Name != "a" {
+		t.Fatalf("repository was modified through a snapshot: %+v", got)
+	}
+}
+
+func TestChairRepositoryIndexes(t *testing.T) {
+	repo := NewChairRepository()
+	repo.Reload(newTestChairs())
+
+	repo.Update("chair2", func(c *Chair) {
+		c.OwnerID = "owner2"
+		c.AccessToken = "token2-rotated"
+	})
+
+	if got := repo.GetByAccessToken("token2"); got != nil {
+		t.Fatalf("old token still resolves: %+v", got)
+	}
+	if got := repo.GetByAccessToken("token2-rotated"); got == nil || got.ID != "chair2" || got.OwnerID != "owner2" {
+		t.Fatalf("new token does not resolve: %+v", got)
+	}
+	if got := repo.ListByOwner("owner1"); len(got) != 1 || got[0].ID != "chair1" {
+		t.Fatalf("unexpected chairs of owner1: %+v", got)
+	}
+	if got := repo.ListByOwner("owner2"); len(got) != 2 || got[0].ID != "chair2" || got[1].ID != "chair3" {
+		t.Fatalf("unexpected chairs of owner2: %+v", got)
+	}
+	if got := repo.Update("missing", func(c *Chair) {}); got != nil {
+		t.Fatalf("updated a missing chair: %+v", got)
+	}
+}
+
+func TestChairRepositoryVersion(t *testing.T) {
+	repo := NewChairRepository()
+	repo.Reload(newTestChairs())
+	loaded := repo.Version()
+
+	chair1 := repo.Get("chair1")
+	chair2 := repo.Get("chair2")
+	if chair1.Version != loaded || !repo.IsCurrent(chair1) || !repo.IsCurrent(chair2) {
+		t.Fatalf("freshly loaded chairs must be current: version=%d chair1=%+v", loaded, chair1)
+	}
+
+	updated := repo.Update("chair1", func(c *Chair) { c.IsActive = true })
+	if repo.Version() != loaded+1 || updated.Version != loaded+1 {
+		t.Fatalf("update did not bump the version: repo=%d chair=%d", repo.Version(), updated.Version)
+	}
+	if repo.IsCurrent(chair1) {
+		t.Fatalf("stale copy was reported as current: %+v", chair1)
+	}
+	if !repo.IsCurrent(updated) || !repo.IsCurrent(chair2) {
+		t.Fatalf("copies that were not changed must stay current")
+	}
+
+	repo.Reload(newTestChairs())
+	if repo.Version() != loaded+2 || repo.IsCurrent(updated) {
+		t.Fatalf("reload must make every earlier copy stale: version=%d", repo.Version())
+	}
+	if repo.IsCurrent(&Chair{ID: "missing"}) {
+		t.Fatalf("missing chair was reported as current")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// chairStatsStore
+// chair_stats をメモリに写したもの。通知のたびに読むので椅子ごとに O(1) で引ける
+type chairStatsStore struct {
+	mu        sync.RWMutex
+	byChairID map[string]ChairStats
+}
+
+var chairStatsCache = &chairStatsStore{byChairID: map[string]ChairStats{}}
+
+func (s *chairStatsStore) Get(chairID string) ChairStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats, ok := s.byChairID[chairID]
+	if !ok {
+		return ChairStats{ChairID: chairID}
+	}
+	return stats
+}
+
+// Add
+// 評価が確定したライド1件分を足す。chair_stats に書き込んだトランザクションのコミット後に呼ぶ
+func (s *chairStatsStore) Add(chairID string, evaluation int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.byChairID[chairID]
+	if !ok {
+		stats = ChairStats{ChairID: chairID}
+	}
+	stats.add(evaluation)
+	s.byChairID[chairID] = stats
+}
+
+func (s *chairStatsStore) Reload(stats []ChairStats) {
+	byChairID := make(map[string]ChairStats, len(stats))
+	for _, st := range stats {
+		byChairID[st.ChairID] = st
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byChairID = byChairID
+}
+
+func (st *ChairStats) add(evaluation int) {
+	st.TotalRides++
+	st.EvaluationSum += evaluation
+	switch evaluation {
+	case 1:
+		st.Evaluation1++
+	case 2:
+		st.Evaluation2++
+	case 3:
+		st.Evaluation3++
+	case 4:
+		st.Evaluation4++
+	case 5:
+		st.Evaluation5++
+	}
+}
+
+// recordChairStats
+// 評価が確定したライドを椅子ごとの集計に足す。ライドを完了させるトランザクションの中で呼ぶ
+func recordChairStats(ctx context.Context, tx *sqlx.Tx, chairID string, evaluation int) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO chair_stats (chair_id, total_rides, evaluation_sum, evaluation_1, evaluation_2, evaluation_3, evaluation_4, evaluation_5)
+VALUES (?, 1, ?, ? = 1, ? = 2, ? = 3, ? = 4, ? = 5)
+ON DUPLICATE KEY UPDATE total_rides    = total_rides + VALUES(total_rides),
+                        evaluation_sum = evaluation_sum + VALUES(evaluation_sum),
+                        evaluation_1   = evaluation_1 + VALUES(evaluation_1),
+                        evaluation_2   = evaluation_2 + VALUES(evaluation_2),
+                        evaluation_3   = evaluation_3 + VALUES(evaluation_3),
+                        evaluation_4   = evaluation_4 + VALUES(evaluation_4),
+                        evaluation_5   = evaluation_5 + VALUES(evaluation_5)`,
+		chairID, evaluation, evaluation, evaluation, evaluation, evaluation, evaluation)
+	return err
+}
+
+// rebuildChairStats
+// 評価済みのライドから椅子ごとの集計を作り直し、メモリに読み込む
+func rebuildChairStats(ctx context.Context) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_stats"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO chair_stats (chair_id, total_rides, evaluation_sum, evaluation_1, evaluation_2, evaluation_3, evaluation_4, evaluation_5)
+SELECT chair_id,
+       COUNT(*),
+       SUM(evaluation),
+       SUM(evaluation = 1),
+       SUM(evaluation = 2),
+       SUM(evaluation = 3),
+       SUM(evaluation = 4),
+       SUM(evaluation = 5)
+FROM rides
+WHERE chair_id IS NOT NULL
+  AND evaluation IS NOT NULL
+GROUP BY chair_id`); err != nil {
+		return err
+	}
+	stats := []ChairStats{}
+	if err := tx.SelectContext(ctx, &stats, "SELECT * FROM chair_stats"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	chairStatsCache.Reload(stats)
+	return nil
+}
+
+// getChairStats
+// 通知に載せる椅子の完了したライドの数と評価の平均をメモリから引く
+func getChairStats(chairID string) appGetNotificationResponseChairStats {
+	stats := chairStatsCache.Get(chairID)
+	res := appGetNotificationResponseChairStats{TotalRidesCount: stats.TotalRides}
+	if stats.TotalRides > 0 {
+		res.TotalEvaluationAvg = float64(stats.EvaluationSum) / float64(stats.TotalRides)
+	}
+	return res
+}
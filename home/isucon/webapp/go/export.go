@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// エクスポートで一度に読み込む行数。結果が大きくてもこの件数ずつ読んで書き出すのでメモリ使用量は増えない
+const exportPageSize = 500
+
+// exportWriter
+// 行を CSV または JSON Lines としてレスポンスに書き出す
+type exportWriter interface {
+	WriteRow(values []any) error
+	Flush() error
+}
+
+// newExportWriter
+// format に応じた exportWriter を作り、ヘッダーを書き出す
+func newExportWriter(w http.ResponseWriter, format, filename string, columns []string) (exportWriter, error) {
+	switch format {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+		w.WriteHeader(http.StatusOK)
+		cw := &csvExportWriter{w: csv.NewWriter(w), flusher: flusherOf(w)}
+		if err := cw.w.Write(columns); err != nil {
+			return nil, err
+		}
+		return cw, nil
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/jsonl; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.jsonl"`, filename))
+		w.WriteHeader(http.StatusOK)
+		return &jsonlExportWriter{w: bufio.NewWriter(w), flusher: flusherOf(w), columns: columns}, nil
+	}
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+func flusherOf(w http.ResponseWriter) http.Flusher {
+	flusher, _ := w.(http.Flusher)
+	return flusher
+}
+
+type csvExportWriter struct {
+	w       *csv.Writer
+	flusher http.Flusher
+}
+
+func (cw *csvExportWriter) WriteRow(values []any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatExportValue(v)
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvExportWriter) Flush() error {
+	cw.w.Flush()
+	if cw.flusher != nil {
+		cw.flusher.Flush()
+	}
+	return cw.w.Error()
+}
+
+type jsonlExportWriter struct {
+	w       *bufio.Writer
+	flusher http.Flusher
+	columns []string
+}
+
+// WriteRow
+// 列の順番を保ったまま1行を1つの JSON オブジェクトとして書き出す
+func (jw *jsonlExportWriter) WriteRow(values []any) error {
+	jw.w.WriteByte('{')
+	for i, column := range jw.columns {
+		if i > 0 {
+			jw.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		jw.w.Write(key)
+		jw.w.WriteByte(':')
+		value, err := json.Marshal(exportJSONValue(values[i]))
+		if err != nil {
+			return err
+		}
+		jw.w.Write(value)
+	}
+	jw.w.WriteByte('}')
+	return jw.w.WriteByte('\n')
+}
+
+func (jw *jsonlExportWriter) Flush() error {
+	if err := jw.w.Flush(); err != nil {
+		return err
+	}
+	if jw.flusher != nil {
+		jw.flusher.Flush()
+	}
+	return nil
+}
+
+// 時刻は UTC の RFC 3339 で書き出す
+func exportJSONValue(v any) any {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return v.UTC().Format(time.RFC3339Nano)
+	case *int:
+		if v == nil {
+			return nil
+		}
+		return *v
+	case sql.NullString:
+		if !v.Valid {
+			return nil
+		}
+		return v.String
+	}
+	return v
+}
+
+func formatExportValue(v any) string {
+	switch v := exportJSONValue(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// exportRideRow
+// エクスポートするライドと、その椅子・オーナーの情報
+type exportRideRow struct {
+	Ride
+	ChairName  sql.NullString `db:"chair_name"`
+	ChairModel sql.NullString `db:"chair_model"`
+	OwnerName  sql.NullString `db:"owner_name"`
+}
+
+// exportRides
+// 完了日時と ID をカーソルにしてライドを exportPageSize 件ずつ読み、書き出す
+// query は直前のページの最後の (completed_at, id) と件数を最後の引数に取り、その次から completed_at, id の順に返すこと
+func exportRides(r *http.Request, ew exportWriter, query string, args []any, toValues func(row *exportRideRow) []any) error {
+	ctx := r.Context()
+	cursorAt := time.Unix(0, 0)
+	cursorID := ""
+	for {
+		rows := []exportRideRow{}
+		pageArgs := append(append([]any{}, args...), cursorAt, cursorAt, cursorID, exportPageSize)
+		if err := db.SelectContext(ctx, &rows, query, pageArgs...); err != nil {
+			return err
+		}
+		for i := range rows {
+			if err := ew.WriteRow(toValues(&rows[i])); err != nil {
+				return err
+			}
+		}
+		if err := ew.Flush(); err != nil {
+			return err
+		}
+		if len(rows) < exportPageSize {
+			return nil
+		}
+		last := rows[len(rows)-1]
+		cursorAt, cursorID = *last.CompletedAt, last.ID
+	}
+}
+
+// ヘッダーを書き出した後はステータスコードを変えられないので、途中のエラーはログに残すだけにする
+func logExportError(r *http.Request, err error) {
+	if err != nil && !errors.Is(err, r.Context().Err()) {
+		slog.Error("export failed", "path", r.URL.Path, "error", err)
+	}
+}
+
+var ownerSalesExportColumns = []string{
+	"ride_id",
+	"chair_id",
+	"chair_name",
+	"chair_model",
+	"requested_at",
+	"completed_at",
+	"pickup_latitude",
+	"pickup_longitude",
+	"destination_latitude",
+	"destination_longitude",
+	"sales",
+	"discount",
+	"commission_rate",
+	"commission",
+	"payout",
+	"evaluation",
+}
+
+// オーナーの売上をライドごとに書き出す
+func ownerGetSalesExport(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	since := time.Unix(0, 0)
+	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if r.URL.Query().Get("until") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = time.UnixMilli(parsed)
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "jsonl" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be csv or jsonl"))
+		return
+	}
+
+	ew, err := newExportWriter(w, format, "sales", ownerSalesExportColumns)
+	if err != nil {
+		logExportError(r, err)
+		return
+	}
+	// until はミリ秒の終わりまで含める
+	// 譲渡された椅子は、このオーナーの椅子として完了したライドだけを書き出す
+	err = exportRides(r, ew, `SELECT rides.*, chairs.name AS chair_name, rides.model AS chair_model, NULL AS owner_name
+FROM rides
+         JOIN chairs ON chairs.id = rides.chair_id
+WHERE rides.owner_id = ?
+  AND rides.completed_at >= ?
+  AND rides.completed_at < ?
+  AND (rides.completed_at > ? OR (rides.completed_at = ? AND rides.id > ?))
+ORDER BY rides.completed_at, rides.id
+LIMIT ?`, []any{owner.ID, since, until.Add(time.Millisecond)}, func(row *exportRideRow) []any {
+		return []any{
+			row.ID,
+			row.ChairID,
+			row.ChairName,
+			row.ChairModel,
+			row.CreatedAt,
+			row.CompletedAt,
+			row.PickupLatitude,
+			row.PickupLongitude,
+			row.DestinationLatitude,
+			row.DestinationLongitude,
+			row.Sale,
+			row.Discount,
+			row.CommissionRate,
+			row.Commission,
+			row.Payout,
+			row.Evaluation,
+		}
+	})
+	logExportError(r, err)
+}
+
+var appRidesExportColumns = []string{
+	"ride_id",
+	"requested_at",
+	"completed_at",
+	"pickup_latitude",
+	"pickup_longitude",
+	"destination_latitude",
+	"destination_longitude",
+	"chair_id",
+	"chair_name",
+	"chair_model",
+	"chair_owner",
+	"gross_fare",
+	"discount",
+	"fare",
+	"evaluation",
+}
+
+// 利用者の完了したライドの履歴を書き出す
+func appGetRidesExport(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "jsonl" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be csv or jsonl"))
+		return
+	}
+
+	ew, err := newExportWriter(w, format, "rides", appRidesExportColumns)
+	if err != nil {
+		logExportError(r, err)
+		return
+	}
+	err = exportRides(r, ew, `SELECT rides.*, chairs.name AS chair_name, rides.model AS chair_model, owners.name AS owner_name
+FROM rides
+         LEFT JOIN chairs ON chairs.id = rides.chair_id
+         LEFT JOIN owners ON owners.id = rides.owner_id
+WHERE rides.user_id = ?
+  AND rides.completed_at IS NOT NULL
+  AND (rides.completed_at > ? OR (rides.completed_at = ? AND rides.id > ?))
+ORDER BY rides.completed_at, rides.id
+LIMIT ?`, []any{user.ID}, func(row *exportRideRow) []any {
+		var fare *int
+		if row.Sale != nil && row.Discount != nil {
+			f := *row.Sale - *row.Discount
+			fare = &f
+		}
+		return []any{
+			row.ID,
+			row.CreatedAt,
+			row.CompletedAt,
+			row.PickupLatitude,
+			row.PickupLongitude,
+			row.DestinationLatitude,
+			row.DestinationLongitude,
+			row.ChairID,
+			row.ChairName,
+			row.ChairModel,
+			row.OwnerName,
+			row.Sale,
+			row.Discount,
+			fare,
+			row.Evaluation,
+		}
+	})
+	logExportError(r, err)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// オーナーに溜まった更新をまとめて送る間隔
+	fleetStreamInterval = time.Second
+	// 1回の送信までに溜めておくライドの状態変更の上限。超えたら古いものから捨てる
+	fleetStreamMaxRideEvents = 1000
+)
+
+type fleetChairLocation struct {
+	ChairID    string `json:"chair_id"`
+	Latitude   int    `json:"latitude"`
+	Longitude  int    `json:"longitude"`
+	RecordedAt int64  `json:"recorded_at"`
+}
+
+type fleetRideEvent struct {
+	RideID    string `json:"ride_id"`
+	ChairID   string `json:"chair_id"`
+	Status    string `json:"status"`
+	ChangedAt int64  `json:"changed_at"`
+}
+
+// fleetSubscriber
+// 1本の SSE 接続に送る前の更新。位置情報は椅子ごとに最新のものだけを持つ
+type fleetSubscriber struct {
+	mu          sync.Mutex
+	locations   map[string]fleetChairLocation
+	rideEvents  []fleetRideEvent
+	droppedRide int
+}
+
+func newFleetSubscriber() *fleetSubscriber {
+	return &fleetSubscriber{locations: map[string]fleetChairLocation{}}
+}
+
+func (s *fleetSubscriber) addLocation(l fleetChairLocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locations[l.ChairID] = l
+}
+
+func (s *fleetSubscriber) addRideEvent(e fleetRideEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rideEvents) == fleetStreamMaxRideEvents {
+		copy(s.rideEvents, s.rideEvents[1:])
+		s.rideEvents = s.rideEvents[:fleetStreamMaxRideEvents-1]
+		s.droppedRide++
+	}
+	s.rideEvents = append(s.rideEvents, e)
+}
+
+// take
+// 溜まっている更新を取り出して空にする
+func (s *fleetSubscriber) take() (locations []fleetChairLocation, rideEvents []fleetRideEvent, dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.locations) > 0 {
+		locations = make([]fleetChairLocation, 0, len(s.locations))
+		for _, l := range s.locations {
+			locations = append(locations, l)
+		}
+		s.locations = map[string]fleetChairLocation{}
+	}
+	rideEvents, s.rideEvents = s.rideEvents, nil
+	dropped, s.droppedRide = s.droppedRide, 0
+	return locations, rideEvents, dropped
+}
+
+// fleetHub
+// オーナーごとに購読中の SSE 接続を持ち、椅子の位置とライドの状態の変更を配る
+type fleetHub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*fleetSubscriber]struct{}
+	// 購読者がいないときは配る前の椅子の検索を省く
+	count atomic.Int64
+}
+
+var fleet = &fleetHub{subscribers: map[string]map[*fleetSubscriber]struct{}{}}
+
+func (h *fleetHub) Subscribe(ownerID string) *fleetSubscriber {
+	s := newFleetSubscriber()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[ownerID] == nil {
+		h.subscribers[ownerID] = map[*fleetSubscriber]struct{}{}
+	}
+	h.subscribers[ownerID][s] = struct{}{}
+	h.count.Add(1)
+	return s
+}
+
+func (h *fleetHub) Unsubscribe(ownerID string, s *fleetSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[ownerID][s]; !ok {
+		return
+	}
+	delete(h.subscribers[ownerID], s)
+	if len(h.subscribers[ownerID]) == 0 {
+		delete(h.subscribers, ownerID)
+	}
+	h.count.Add(-1)
+}
+
+func (h *fleetHub) hasSubscribers() bool {
+	return h.count.Load() > 0
+}
+
+func (h *fleetHub) each(ownerID string, fn func(s *fleetSubscriber)) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subscribers[ownerID] {
+		fn(s)
+	}
+}
+
+// PublishLocation
+// 椅子の位置を、その椅子のオーナーの購読者に配る
+func (h *fleetHub) PublishLocation(cl *ChairLocation) {
+	if !h.hasSubscribers() {
+		return
+	}
+	chair := chairRepository.Get(cl.ChairID)
+	if chair == nil {
+		return
+	}
+	l := fleetChairLocation{
+		ChairID:    cl.ChairID,
+		Latitude:   cl.Latitude,
+		Longitude:  cl.Longitude,
+		RecordedAt: cl.CreatedAt.UnixMilli(),
+	}
+	h.each(chair.OwnerID, func(s *fleetSubscriber) { s.addLocation(l) })
+}
+
+// PublishRideStatus
+// ライドの状態の変更を、割り当てられた椅子のオーナーの購読者に配る
+func (h *fleetHub) PublishRideStatus(chairID, rideID, status string, changedAt time.Time) {
+	if !h.hasSubscribers() {
+		return
+	}
+	chair := chairRepository.Get(chairID)
+	if chair == nil {
+		return
+	}
+	e := fleetRideEvent{
+		RideID:    rideID,
+		ChairID:   chairID,
+		Status:    status,
+		ChangedAt: changedAt.UnixMilli(),
+	}
+	h.each(chair.OwnerID, func(s *fleetSubscriber) { s.addRideEvent(e) })
+}
+
+// rideStatusChanges
+// トランザクションの中で遷移させたライドの状態。ロールバックされた変更を配らないように、コミットした後に Publish で配る
+type rideStatusChanges struct {
+	events []fleetRideEvent
+}
+
+// record
+// ride_statuses に書き込んだ状態の変更を溜める。椅子が割り当てられていないライドは配らないので溜めない
+func (c *rideStatusChanges) record(ctx context.Context, q sqlx.QueryerContext, rideID, status string, changedAt time.Time) error {
+	if !fleet.hasSubscribers() {
+		return nil
+	}
+	var chairID *string
+	if err := sqlx.GetContext(ctx, q, &chairID, "SELECT chair_id FROM rides WHERE id = ?", rideID); err != nil {
+		return err
+	}
+	if chairID != nil {
+		c.events = append(c.events, fleetRideEvent{
+			RideID:    rideID,
+			ChairID:   *chairID,
+			Status:    status,
+			ChangedAt: changedAt.UnixMilli(),
+		})
+	}
+	return nil
+}
+
+// Publish
+// 溜めた状態の変更を配る。トランザクションのコミット後に呼ぶ
+func (c *rideStatusChanges) Publish() {
+	for _, e := range c.events {
+		fleet.PublishRideStatus(e.ChairID, e.RideID, e.Status, time.UnixMilli(e.ChangedAt))
+	}
+}
+
+type fleetStreamChair struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	Model    string              `json:"model"`
+	Active   bool                `json:"active"`
+	Location *fleetChairLocation `json:"location"`
+}
+
+type fleetStreamSnapshot struct {
+	Chairs []fleetStreamChair `json:"chairs"`
+}
+
+type fleetStreamUpdate struct {
+	Locations []fleetChairLocation `json:"locations"`
+	Rides     []fleetRideEvent     `json:"rides"`
+	// 上限を超えて捨てたライドの状態変更の数
+	DroppedRides int `json:"dropped_rides,omitempty"`
+}
+
+func writeFleetStreamEvent(w http.ResponseWriter, event string, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Write([]byte("event: " + event + "\ndata: "))
+	w.Write(buf)
+	if _, err := w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// オーナーの全椅子の位置とライドの状態の変更を SSE で送る
+// 接続直後に snapshot で椅子の一覧と最新の位置を送り、以降は update で1秒ごとに変更分だけを送る
+func ownerGetFleetStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	// スナップショットを作る前に購読を始めて、その間の変更を取りこぼさないようにする
+	subscriber := fleet.Subscribe(owner.ID)
+	defer fleet.Unsubscribe(owner.ID, subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	snapshot := fleetStreamSnapshot{Chairs: []fleetStreamChair{}}
+	for _, chair := range chairRepository.ListByOwner(owner.ID) {
+		c := fleetStreamChair{
+			ID:     chair.ID,
+			Name:   chair.Name,
+			Model:  chair.Model,
+			Active: chair.IsActive,
+		}
+		if cl := GetChairLocation(chair.ID); cl != nil {
+			c.Location = &fleetChairLocation{
+				ChairID:    cl.ChairID,
+				Latitude:   cl.Latitude,
+				Longitude:  cl.Longitude,
+				RecordedAt: cl.CreatedAt.UnixMilli(),
+			}
+		}
+		snapshot.Chairs = append(snapshot.Chairs, c)
+	}
+	if err := writeFleetStreamEvent(w, "snapshot", snapshot); err != nil {
+		slog.Error("failed to write fleet snapshot", "error", err, "owner_id", owner.ID)
+		return
+	}
+
+	ticker := time.NewTicker(fleetStreamInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			locations, rideEvents, dropped := subscriber.take()
+			if len(locations) == 0 && len(rideEvents) == 0 && dropped == 0 {
+				continue
+			}
+			update := fleetStreamUpdate{
+				Locations:    locations,
+				Rides:        rideEvents,
+				DroppedRides: dropped,
+			}
+			if update.Locations == nil {
+				update.Locations = []fleetChairLocation{}
+			}
+			if update.Rides == nil {
+				update.Rides = []fleetRideEvent{}
+			}
+			if err := writeFleetStreamEvent(w, "update", update); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-serverShuttingDown:
+			return
+		}
+	}
+}
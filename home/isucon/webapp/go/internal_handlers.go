@@ -3,8 +3,105 @@ package main
 import (
 	"net/http"
 	"slices"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
+const (
+	// 予約日時のこの時間前から予約ライドを椅子確保の対象にする
+	scheduledRideMatchingWindow = 10 * time.Minute
+	// 椅子は座標送信1回あたり速度分だけ移動するとみなし、その送信間隔の見込み
+	chairMoveIntervalEstimate = time.Second
+	// 予約日時に遅れないように見込む余裕
+	scheduledRideArrivalMargin = 30 * time.Second
+
+	// 1台の椅子で相乗りできるライドの最大数
+	poolCapacity = 3
+	// 相乗りの行程で、各ライドが単独で直行するより余計に進んでよい距離の上限
+	poolDetourLimit = 10
+	// 相乗り相手が見つからないライドを単独で割り当てるまで待つ時間
+	poolWaitTime = 3 * time.Second
+)
+
+// 候補の椅子のうち、指定地点に最も近い椅子のindexを返す
+func selectNearestChairIndex(candidateChairs []Chair, latitude, longitude int) int {
+	selectedChair := candidateChairs[0]
+	selectedIndex := 0
+	for index, chair := range candidateChairs {
+		selectedChairLocation := GetChairLocation(selectedChair.ID)
+		candidateChairLocation := GetChairLocation(chair.ID)
+		if abs(selectedChairLocation.Latitude-latitude)+abs(selectedChairLocation.Longitude-longitude) > abs(candidateChairLocation.Latitude-latitude)+abs(candidateChairLocation.Longitude-longitude) {
+			selectedChair = chair
+			selectedIndex = index
+		}
+	}
+	return selectedIndex
+}
+
+// schedulableRides
+// 予約日時の順に並んだ予約ライドのうち、椅子を確保してよいものを返す
+// 終わっていないライドがある利用者の予約は除き、同じ利用者の予約は最も早いものだけを対象にする
+func schedulableRides(scheduledRides []Ride, busyUserIDs map[string]struct{}) []Ride {
+	seenUserIDs := make(map[string]struct{}, len(scheduledRides))
+	rides := make([]Ride, 0, len(scheduledRides))
+	for _, ride := range scheduledRides {
+		if _, ok := busyUserIDs[ride.UserID]; ok {
+			continue
+		}
+		if _, ok := seenUserIDs[ride.UserID]; ok {
+			continue
+		}
+		seenUserIDs[ride.UserID] = struct{}{}
+		rides = append(rides, ride)
+	}
+	return rides
+}
+
+// poolDetours
+// 相乗りの行程(buildPoolItinerary と同じく乗車地を順に回ってから目的地を順に回る)で、
+// 各ライドが乗車してから降りるまでに進む距離と、単独で直行したときの距離との差を返す
+func poolDetours(group []Ride) []int {
+	stops := make([]Coordinate, 0, len(group)*2)
+	for _, ride := range group {
+		stops = append(stops, Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude})
+	}
+	for _, ride := range group {
+		stops = append(stops, Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude})
+	}
+	// traveled[i] は最初の乗車地から i 番目の停車地までに進む距離
+	traveled := make([]int, len(stops))
+	for i := 1; i < len(stops); i++ {
+		traveled[i] = traveled[i-1] + calculateDistance(stops[i-1].Latitude, stops[i-1].Longitude, stops[i].Latitude, stops[i].Longitude)
+	}
+
+	detours := make([]int, len(group))
+	for i, ride := range group {
+		solo := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		detours[i] = traveled[len(group)+i] - traveled[i] - solo
+	}
+	return detours
+}
+
+// buildPoolGroup
+// leader に、後から来た相乗りライドを定員まで順に加える。加えても全員の遠回りが poolDetourLimit に収まるものだけを加える
+func buildPoolGroup(leader Ride, rest []Ride, groupedRideIDs map[string]struct{}) []Ride {
+	group := []Ride{leader}
+	for _, ride := range rest {
+		if len(group) >= poolCapacity {
+			break
+		}
+		if _, ok := groupedRideIDs[ride.ID]; ok {
+			continue
+		}
+		candidate := append(slices.Clip(group), ride)
+		if slices.Max(poolDetours(candidate)) <= poolDetourLimit {
+			group = candidate
+		}
+	}
+	return group
+}
+
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -16,11 +113,36 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	now := time.Now()
+
 	rides := []Ride{}
-	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at`); err != nil {
+	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id IS NULL AND scheduled_at IS NULL AND pooled = FALSE ORDER BY created_at`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pooledRides := []Ride{}
+	if err := tx.SelectContext(ctx, &pooledRides, `SELECT * FROM rides WHERE chair_id IS NULL AND scheduled_at IS NULL AND pooled = TRUE ORDER BY created_at`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	scheduledRides := []Ride{}
+	if err := tx.SelectContext(ctx, &scheduledRides, `SELECT * FROM rides WHERE chair_id IS NULL AND canceled_at IS NULL AND scheduled_at <= ? ORDER BY scheduled_at`, now.Add(scheduledRideMatchingWindow)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 予約ライドは同じ利用者の終わっていないライドと同時に進められないので、その利用者の予約はまだ確保しない
+	busyUserIDs := []string{}
+	if err := tx.SelectContext(ctx, &busyUserIDs, `SELECT DISTINCT user_id FROM rides WHERE evaluation IS NULL AND canceled_at IS NULL AND (scheduled_at IS NULL OR chair_id IS NOT NULL)`); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	busyUserIDsSet := make(map[string]struct{}, len(busyUserIDs))
+	for _, id := range busyUserIDs {
+		busyUserIDsSet[id] = struct{}{}
+	}
 
 	notCompletedChairIDs := []string{}
 	if err := tx.SelectContext(ctx, &notCompletedChairIDs, `SELECT chair_id FROM rides where evaluation IS NULL AND chair_id IS NOT NULL`); err != nil {
@@ -41,7 +163,7 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	}
 
 	chairs := []Chair{}
-	if err := tx.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE is_active = TRUE`); err != nil {
+	if err := tx.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE is_active = TRUE AND retired_at IS NULL`); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -52,31 +174,98 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	for _, ride := range rides {
+	chairModels := []ChairModel{}
+	if err := tx.SelectContext(ctx, &chairModels, `SELECT * FROM chair_models`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	speedByModel := make(map[string]int, len(chairModels))
+	for _, model := range chairModels {
+		speedByModel[model.Name] = model.Speed
+	}
+
+	// 予約ライドは予約日時に間に合うぎりぎりまで椅子を確保せず、間に合わなくなる前に優先して確保する
+	changes := &rideStatusChanges{}
+	for _, ride := range schedulableRides(scheduledRides, busyUserIDsSet) {
 		if len(candidateChairs) == 0 {
 			break
 		}
-		selectedChair := candidateChairs[0]
-		selectedIndex := 0
-		for index, chair := range candidateChairs {
-			selectedChairLocation := GetChairLocation(selectedChair.ID)
-			candidateChairLocation := GetChairLocation(chair.ID)
-			if abs(selectedChairLocation.Latitude-ride.PickupLatitude)+abs(selectedChairLocation.Longitude-ride.PickupLongitude) > abs(candidateChairLocation.Latitude-ride.PickupLatitude)+abs(candidateChairLocation.Longitude-ride.PickupLongitude) {
-				selectedChair = chair
-				selectedIndex = index
-			}
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if status != "SCHEDULED" {
+			continue
 		}
+
+		selectedIndex := selectNearestChairIndex(candidateChairs, ride.PickupLatitude, ride.PickupLongitude)
+		selectedChair := candidateChairs[selectedIndex]
+		selectedChairLocation := GetChairLocation(selectedChair.ID)
+		distance := calculateDistance(selectedChairLocation.Latitude, selectedChairLocation.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+		speed := max(speedByModel[selectedChair.Model], 1)
+		travelTime := time.Duration((distance+speed-1)/speed) * chairMoveIntervalEstimate
+		if now.Add(travelTime + scheduledRideArrivalMargin).Before(*ride.ScheduledAt) {
+			continue
+		}
+
 		candidateChairs = slices.Delete(candidateChairs, selectedIndex, selectedIndex+1)
-		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ? AND chair_id IS NULL", selectedChair.ID, ride.ID); err != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ?, assigned_at = ? WHERE id = ? AND chair_id IS NULL", selectedChair.ID, now, ride.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		if err := transitionRideStatus(ctx, tx, changes, ride.ID, "MATCHING"); err != nil {
+			writeRideStatusError(w, err)
+			return
+		}
+	}
+
+	for _, ride := range rides {
+		if len(candidateChairs) == 0 {
+			break
+		}
+		selectedIndex := selectNearestChairIndex(candidateChairs, ride.PickupLatitude, ride.PickupLongitude)
+		selectedChair := candidateChairs[selectedIndex]
+		candidateChairs = slices.Delete(candidateChairs, selectedIndex, selectedIndex+1)
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ?, assigned_at = ? WHERE id = ? AND chair_id IS NULL", selectedChair.ID, now, ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// 相乗りライドは乗車地と目的地がそれぞれ近いものを定員までまとめて1台の椅子に割り当てる
+	groupedRideIDs := make(map[string]struct{}, len(pooledRides))
+	for i, leader := range pooledRides {
+		if len(candidateChairs) == 0 {
+			break
+		}
+		if _, ok := groupedRideIDs[leader.ID]; ok {
+			continue
+		}
+
+		group := buildPoolGroup(leader, pooledRides[i+1:], groupedRideIDs)
+		if len(group) == 1 && now.Sub(leader.CreatedAt) < poolWaitTime {
+			continue
+		}
+
+		selectedIndex := selectNearestChairIndex(candidateChairs, leader.PickupLatitude, leader.PickupLongitude)
+		selectedChair := candidateChairs[selectedIndex]
+		candidateChairs = slices.Delete(candidateChairs, selectedIndex, selectedIndex+1)
+		poolID := ulid.Make().String()
+		for _, ride := range group {
+			groupedRideIDs[ride.ID] = struct{}{}
+			if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ?, pool_id = ?, assigned_at = ? WHERE id = ? AND chair_id IS NULL", selectedChair.ID, poolID, now, ride.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	changes.Publish()
 
 	w.WriteHeader(http.StatusNoContent)
 }
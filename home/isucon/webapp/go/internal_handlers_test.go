@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSchedulableRides(t *testing.T) {
+	scheduled := []Ride{
+		{ID: "ride1", UserID: "user1"},
+		{ID: "ride2", UserID: "user2"},
+		{ID: "ride3", UserID: "user1"},
+		{ID: "ride4", UserID: "user3"},
+	}
+	tests := []struct {
+		name        string
+		busyUserIDs []string
+		want        []string
+	}{
+		{name: "earliest reservation per user", want: []string{"ride1", "ride2", "ride4"}},
+		{name: "user with a ride in progress is deferred", busyUserIDs: []string{"user1"}, want: []string{"ride2", "ride4"}},
+		{name: "every user busy", busyUserIDs: []string{"user1", "user2", "user3"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			busy := make(map[string]struct{}, len(tt.busyUserIDs))
+			for _, id := range tt.busyUserIDs {
+				busy[id] = struct{}{}
+			}
+			got := []string{}
+			for _, ride := range schedulableRides(scheduled, busy) {
+				got = append(got, ride.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("schedulableRides() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newPoolRide(id string, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) Ride {
+	return Ride{
+		ID:                   id,
+		PickupLatitude:       pickupLatitude,
+		PickupLongitude:      pickupLongitude,
+		DestinationLatitude:  destLatitude,
+		DestinationLongitude: destLongitude,
+		Pooled:               true,
+	}
+}
+
+func TestPoolDetours(t *testing.T) {
+	tests := []struct {
+		name  string
+		group []Ride
+		want  []int
+	}{
+		{
+			name:  "alone",
+			group: []Ride{newPoolRide("a", 0, 0, 30, 0)},
+			want:  []int{0},
+		},
+		{
+			name:  "same direction",
+			group: []Ride{newPoolRide("a", 0, 0, 30, 0), newPoolRide("b", 3, 0, 33, 0)},
+			want:  []int{0, 0},
+		},
+		{
+			// 乗車地同士も目的地同士も 10 しか離れていないが、並んで同じ向きに進まないので遠回りになる
+			name:  "side by side",
+			group: []Ride{newPoolRide("a", 0, 0, 10, 0), newPoolRide("b", 0, 10, 10, 10)},
+			want:  []int{20, 20},
+		},
+		{
+			name:  "opposite directions",
+			group: []Ride{newPoolRide("a", 0, 0, 30, 0), newPoolRide("b", 2, 0, -28, 0)},
+			want:  []int{0, 56},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := poolDetours(tt.group); !slices.Equal(got, tt.want) {
+				t.Fatalf("poolDetours() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildPoolGroup(t *testing.T) {
+	leader := newPoolRide("leader", 0, 0, 30, 0)
+	tests := []struct {
+		name    string
+		rest    []Ride
+		grouped []string
+		want    []string
+	}{
+		{
+			name: "rides along the way are pooled",
+			rest: []Ride{newPoolRide("a", 2, 0, 32, 0), newPoolRide("b", 1, 0, 29, 0)},
+			want: []string{"leader", "a", "b"},
+		},
+		{
+			name: "nearby pickup heading the other way is rejected",
+			rest: []Ride{newPoolRide("a", 2, 0, -28, 0), newPoolRide("b", 1, 0, 29, 0)},
+			want: []string{"leader", "b"},
+		},
+		{
+			name: "pickups and destinations close but not on the way are rejected",
+			rest: []Ride{newPoolRide("a", 0, 10, 30, 10)},
+			want: []string{"leader"},
+		},
+		{
+			name: "capacity",
+			rest: []Ride{newPoolRide("a", 0, 0, 30, 0), newPoolRide("b", 0, 0, 30, 0), newPoolRide("c", 0, 0, 30, 0)},
+			want: []string{"leader", "a", "b"},
+		},
+		{
+			name:    "already grouped rides are skipped",
+			rest:    []Ride{newPoolRide("a", 0, 0, 30, 0), newPoolRide("b", 0, 0, 30, 0)},
+			grouped: []string{"a"},
+			want:    []string{"leader", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grouped := make(map[string]struct{}, len(tt.grouped))
+			for _, id := range tt.grouped {
+				grouped[id] = struct{}{}
+			}
+			got := []string{}
+			for _, ride := range buildPoolGroup(leader, tt.rest, grouped) {
+				got = append(got, ride.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("buildPoolGroup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,22 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"sort"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/oklog/ulid/v2"
-
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-sql-driver/mysql"
@@ -26,66 +27,216 @@ const RetryAfterMs = 1500
 
 var db *sqlx.DB
 
-var ChairMap = sync.Map{}
+// 椅子を ID・アクセストークン・オーナーごとに引けるように持つ
+var chairRepository = NewChairRepository()
+
 var ChairLocationMap = sync.Map{}
 
-func UpdateChair(chair *Chair, updatedAt *time.Time) {
-	if updatedAt != nil {
-		chair.UpdatedAt = *updatedAt
-	} else {
-		chair.UpdatedAt = time.Now()
+// サーバーの停止が始まると閉じる。SSE のように終わらないリクエストはこれを見て接続を終える
+var serverShuttingDown = make(chan struct{})
+
+var UserMap = sync.Map{}
+var OwnerMap = sync.Map{}
+
+// アクセストークンをキーにして *Session を持つ
+var SessionMap = sync.Map{}
+
+func UpdateUser(user *User) {
+	UserMap.Store(user.ID, user)
+}
+
+// GetUser
+// IDをキーにしてUserを取得する
+func GetUser(id string) *User {
+	if v, ok := UserMap.Load(id); ok {
+		return v.(*User)
 	}
-	ChairMap.Store(chair.ID, chair)
-	ChairMap.Store(chair.AccessToken, chair)
+	return nil
 }
 
-func InsertChairLocation(cl *ChairLocation) {
-	ChairLocationMap.Store(cl.ID, cl)
-	ChairLocationMap.Store(cl.ChairID, cl)
+func UpdateOwner(owner *Owner) {
+	OwnerMap.Store(owner.ID, owner)
 }
 
-// GetChair
-// AccessTokenかIDをキーにしてChairを取得する
-func GetChair(key string) *Chair {
-	if v, ok := ChairMap.Load(key); ok {
-		return v.(*Chair)
+// GetOwner
+// IDをキーにしてOwnerを取得する
+func GetOwner(id string) *Owner {
+	if v, ok := OwnerMap.Load(id); ok {
+		return v.(*Owner)
 	}
 	return nil
 }
 
-// GetChairLocation
-// ID か ChairID をキーにして ChairLocation を取得する
-func GetChairLocation(key string) *ChairLocation {
-	if v, ok := ChairLocationMap.Load(key); ok {
-		return v.(*ChairLocation)
+func StoreSession(session *Session) {
+	SessionMap.Store(session.Token, session)
+}
+
+// GetSession
+// アクセストークンをキーにして有効期限内の Session を取得する
+func GetSession(accessToken string) *Session {
+	v, ok := SessionMap.Load(accessToken)
+	if !ok {
+		return nil
 	}
-	return nil
+	session := v.(*Session)
+	if !session.ExpiresAt.After(time.Now()) {
+		SessionMap.Delete(accessToken)
+		return nil
+	}
+	return session
 }
 
-// ListChairLocations
-// ChairID をキーにして ChairLocation list を取得する
-func ListChairLocations(key string) (cls []*ChairLocation) {
-	ChairLocationMap.Range(func(k, v any) bool {
-		if key == k.(string) {
-			return true
-		}
+// InvalidateSession
+// アクセストークンを無効にする。以降そのトークンでの認証は即座に失敗する
+func InvalidateSession(accessToken string) {
+	SessionMap.Delete(accessToken)
+}
 
-		cl := v.(*ChairLocation)
-		if cl.ChairID == key {
-			cls = append(cls, cl)
+// InvalidatePrincipalSessions
+// 利用者・オーナー・椅子のすべてのセッションを無効にする
+func InvalidatePrincipalSessions(principalType, principalID string) {
+	SessionMap.Range(func(k, v any) bool {
+		session := v.(*Session)
+		if session.PrincipalType == principalType && session.PrincipalID == principalID {
+			SessionMap.Delete(k)
 		}
 		return true
 	})
-	sort.Slice(cls, func(i, j int) bool {
-		return cls[i].ID < cls[j].ID
-	})
-	return
+}
+
+// loadSessions
+// users と owners と有効期限内の sessions をメモリに読み込み直す
+func loadSessions(ctx context.Context) error {
+	users := []User{}
+	if err := db.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
+		return err
+	}
+	owners := []Owner{}
+	if err := db.SelectContext(ctx, &owners, "SELECT * FROM owners"); err != nil {
+		return err
+	}
+	sessions := []Session{}
+	if err := db.SelectContext(ctx, &sessions, "SELECT * FROM sessions WHERE expires_at > NOW(6)"); err != nil {
+		return err
+	}
+
+	UserMap.Clear()
+	for _, user := range users {
+		UpdateUser(&user)
+	}
+	OwnerMap.Clear()
+	for _, owner := range owners {
+		UpdateOwner(&owner)
+	}
+	SessionMap.Clear()
+	for _, session := range sessions {
+		StoreSession(&session)
+	}
+	return nil
+}
+
+// chairLocationTrack
+// 椅子の最新の位置と総移動距離、直近の位置情報
+type chairLocationTrack struct {
+	mu                     sync.Mutex
+	latest                 *ChairLocation
+	totalDistance          int
+	totalDistanceUpdatedAt time.Time
+	history                chairLocationHistory
+}
+
+// InsertChairLocation
+// 椅子の最新の位置を更新し、一個前の位置からの移動距離を足した総移動距離を返す
+func InsertChairLocation(cl *ChairLocation) int {
+	v, _ := ChairLocationMap.LoadOrStore(cl.ChairID, &chairLocationTrack{})
+	track := v.(*chairLocationTrack)
+
+	track.mu.Lock()
+	if prev := track.latest; prev != nil {
+		track.totalDistance += abs(cl.Latitude-prev.Latitude) + abs(cl.Longitude-prev.Longitude)
+	}
+	track.totalDistanceUpdatedAt = cl.CreatedAt
+	track.latest = cl
+	track.history.push(cl)
+	totalDistance := track.totalDistance
+	track.mu.Unlock()
+
+	fleet.PublishLocation(cl)
+	return totalDistance
+}
+
+func getChairLocationTrack(chairID string) *chairLocationTrack {
+	if v, ok := ChairLocationMap.Load(chairID); ok {
+		return v.(*chairLocationTrack)
+	}
+	return nil
+}
+
+// GetChairLocation
+// ChairID をキーにして最新の ChairLocation を取得する
+func GetChairLocation(chairID string) *ChairLocation {
+	track := getChairLocationTrack(chairID)
+	if track == nil {
+		return nil
+	}
+	track.mu.Lock()
+	defer track.mu.Unlock()
+	return track.latest
+}
+
+// GetChairTotalDistance
+// ChairID をキーにして総移動距離と最後に更新した時刻を取得する
+func GetChairTotalDistance(chairID string) (int, time.Time) {
+	track := getChairLocationTrack(chairID)
+	if track == nil {
+		return 0, time.Time{}
+	}
+	track.mu.Lock()
+	defer track.mu.Unlock()
+	return track.totalDistance, track.totalDistanceUpdatedAt
+}
+
+// ListRecentChairLocations
+// ChairID をキーにしてメモリに残っている直近の ChairLocation を古い順に取得する
+func ListRecentChairLocations(chairID string) []*ChairLocation {
+	track := getChairLocationTrack(chairID)
+	if track == nil {
+		return nil
+	}
+	track.mu.Lock()
+	defer track.mu.Unlock()
+	return track.history.list()
 }
 
 func main() {
 	mux := setup()
-	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	server.RegisterOnShutdown(func() { close(serverShuttingDown) })
+	go func() {
+		slog.Info("Listening on :8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve", "error", err)
+			stop()
+		}
+	}()
+	<-ctx.Done()
+
+	// 受け付け中のリクエストを終わらせてから、書き込み待ちの位置情報を書き込む
+	// サーバーの停止に時間を使い切っても位置情報を書き込めるように、それぞれに期限を設ける
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shutdown server", "error", err)
+	}
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelClose()
+	if err := chairLocations.Close(closeCtx); err != nil {
+		slog.Error("failed to flush chair locations", "error", err)
+	}
 }
 
 func setup() http.Handler {
@@ -128,30 +279,61 @@ func setup() http.Handler {
 	}
 	db = _db
 
+	chairLocations = newChairLocationWriter()
+	publishChairLocationWriterVars()
+
+	signer, err = loadTokenSigner()
+	if err != nil {
+		panic(err)
+	}
+	if signer != nil {
+		if err := loadRevokedTokens(context.Background()); err != nil {
+			panic(err)
+		}
+		go watchRevokedTokens()
+	}
+
 	{
 		// chairの情報を起動時にメモリに持っておく
-		ChairMap = sync.Map{}
 		chairs := []Chair{}
 		if err := db.Select(&chairs, "SELECT * FROM chairs"); err != nil {
 			panic(err)
 		}
-		for _, chair := range chairs {
-			UpdateChair(&chair, &chair.UpdatedAt)
+		chairRepository.Reload(chairs)
+	}
+
+	{
+		// users と owners とセッションの情報を起動時にメモリに持っておく
+		if err := loadSessions(context.Background()); err != nil {
+			panic(err)
 		}
 	}
 
 	{
-		// chair_locations の情報を起動時にメモリに持っておく
-		ChairLocationMap = sync.Map{}
-		data := []ChairLocation{}
-		if err := db.Select(&data, "SELECT * FROM chair_locations ORDER BY id"); err != nil {
+		// 精算額を記録する前に完了したライドの精算額を埋め、日ごとの売上と椅子ごとの評価の集計を作り直す
+		if err := backfillRideSettlements(context.Background()); err != nil {
 			panic(err)
 		}
-		for _, cl := range data {
-			InsertChairLocation(&cl)
+		if err := rebuildSalesDaily(context.Background()); err != nil {
+			panic(err)
+		}
+		if err := rebuildChairStats(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+
+	{
+		// 椅子の総移動距離と直近の位置情報を起動時にメモリに持っておく
+		if err := loadChairLocations(context.Background()); err != nil {
+			panic(err)
 		}
 	}
 
+	signupLimiter := rateLimitMiddleware(newRateLimiter("signup", signupRateLimit, 0), rateLimitByIP)
+	appLimiter := rateLimitMiddleware(newRateLimiter("app", appRateLimit, 0), rateLimitByToken(RoleUser))
+	// 椅子のクライアントは RetryAfterMs の間隔で動いているので、それより短い待ち時間は指示しない
+	chairLimiter := rateLimitMiddleware(newRateLimiter("chair", chairRateLimit, RetryAfterMs*time.Millisecond), rateLimitByToken(RoleChair))
+
 	mux := chi.NewRouter()
 	mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
@@ -160,41 +342,74 @@ func setup() http.Handler {
 
 	// app handlers
 	{
-		mux.HandleFunc("POST /api/app/users", appPostUsers)
+		mux.With(signupLimiter).HandleFunc("POST /api/app/users", appPostUsers)
+		mux.HandleFunc("POST /api/app/logout", appSessionHandlers.postLogout)
+		mux.HandleFunc("POST /api/app/logout-all", appSessionHandlers.postLogoutAll)
+		mux.HandleFunc("POST /api/app/session/refresh", appSessionHandlers.postRefresh)
 
-		authedMux := mux.With(appAuthMiddleware)
+		authedMux := mux.With(authMiddleware(RoleUser))
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
-		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
-		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
-		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.With(appLimiter).HandleFunc("POST /api/app/rides", appPostRides)
+		authedMux.HandleFunc("GET /api/app/rides/scheduled", appGetScheduledRides)
+		authedMux.HandleFunc("GET /api/app/rides/export", appGetRidesExport)
+		authedMux.With(appLimiter).HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+
+		rideMux := authedMux.With(appRideAccessMiddleware)
+		rideMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		rideMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
 	}
 
 	// owner handlers
 	{
-		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
+		mux.With(signupLimiter).HandleFunc("POST /api/owner/owners", ownerPostOwners)
+		mux.HandleFunc("POST /api/owner/logout", ownerSessionHandlers.postLogout)
+		mux.HandleFunc("POST /api/owner/logout-all", ownerSessionHandlers.postLogoutAll)
+		mux.HandleFunc("POST /api/owner/session/refresh", ownerSessionHandlers.postRefresh)
 
-		authedMux := mux.With(ownerAuthMiddleware)
+		authedMux := mux.With(authMiddleware(RoleOwner))
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/timeseries", ownerGetSalesTimeseries)
+		authedMux.HandleFunc("GET /api/owner/sales/export", ownerGetSalesExport)
+		authedMux.HandleFunc("GET /api/owner/statements/{month}", ownerGetStatement)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/fleet/stream", ownerGetFleetStream)
+		authedMux.HandleFunc("GET /api/owner/chair-register-tokens", ownerGetChairRegisterTokens)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens", ownerPostChairRegisterToken)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens/{token_id}/revoke", ownerPostChairRegisterTokenRevoke)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens/{token_id}/rotate", ownerPostChairRegisterTokenRotate)
+
+		// オーナーが自分の椅子として操作するルート
+		chairMux := authedMux.With(ownerChairMiddleware)
+		chairMux.HandleFunc("POST /api/owner/chairs/{chair_id}/credentials/revoke", ownerPostChairCredentialRevoke)
+		chairMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		chairMux.HandleFunc("GET /api/owner/chairs/{chair_id}/stats", ownerGetChairStats)
+		chairMux.HandleFunc("GET /api/owner/chairs/{chair_id}/feedback", ownerGetChairFeedback)
+		chairMux.HandleFunc("POST /api/owner/chairs/{chair_id}/deactivate", ownerPostChairDeactivate)
+		chairMux.HandleFunc("POST /api/owner/chairs/{chair_id}/retire", ownerPostChairRetire)
+		chairMux.HandleFunc("POST /api/owner/chairs/{chair_id}/transfer", ownerPostChairTransfer)
 	}
 
 	// chair handlers
 	{
-		mux.HandleFunc("POST /api/chair/chairs", chairPostChairs)
+		mux.With(signupLimiter).HandleFunc("POST /api/chair/chairs", chairPostChairs)
 
-		authedMux := mux.With(chairAuthMiddleware)
+		authedMux := mux.With(authMiddleware(RoleChair))
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
-		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
+		authedMux.With(chairLimiter).HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
 		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
-		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+
+		rideMux := authedMux.With(chairRideAccessMiddleware)
+		rideMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+		mux.With(internalOnlyMiddleware).HandleFunc("GET /api/internal/chair-distances/check", internalGetChairDistanceCheck)
+		mux.With(internalOnlyMiddleware).HandleFunc("POST /api/internal/sales/rebuild", internalPostSalesRebuild)
 	}
 
 	// pprof
@@ -219,6 +434,12 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 初期化の後に前回の位置情報が書き込まれないように、先に書き込んでおく
+	if err := chairLocations.Flush(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
@@ -229,48 +450,37 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chairLocations := []ChairLocation{}
-	if err := db.SelectContext(ctx, &chairLocations, "SELECT * FROM chair_locations ORDER BY created_at"); err != nil {
+	if err := loadChairLocations(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	prevChairLocations := make(map[string]ChairLocation)
-	distanceByChairID := make(map[string]int)
-	for _, cl := range chairLocations {
-		InsertChairLocation(&cl)
-		prevChairLocation, ok := prevChairLocations[cl.ChairID]
-		prevChairLocations[cl.ChairID] = cl
-		if !ok {
-			continue
-		}
-		distanceByChairID[cl.ChairID] += abs(cl.Latitude-prevChairLocation.Latitude) + abs(cl.Longitude-prevChairLocation.Longitude)
-	}
-	chairTotalDistances := make([]ChairTotalDistance, 0, len(distanceByChairID))
-	for chairID, distance := range distanceByChairID {
-		chairTotalDistances = append(chairTotalDistances, ChairTotalDistance{
-			ID:       ulid.Make().String(),
-			ChairID:  chairID,
-			Distance: distance,
-		})
-	}
-	_, err := db.NamedExecContext(
-		ctx,
-		"INSERT INTO chair_locations_minus_distance (id, chair_id, distance) VALUES (:id, :chair_id, :distance)",
-		chairTotalDistances,
-	)
-	if err != nil {
+	if err := backfillRideSettlements(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := rebuildSalesDaily(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := rebuildChairStats(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	ChairMap = sync.Map{}
 	chairs := []Chair{}
 	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs"); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	for _, chair := range chairs {
-		UpdateChair(&chair, &chair.UpdatedAt)
+	chairRepository.Reload(chairs)
+
+	if err := loadSessions(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := loadRevokedTokens(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
 	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
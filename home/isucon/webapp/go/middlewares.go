@@ -4,74 +4,243 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 )
 
-func appAuthMiddleware(next http.Handler) http.Handler {
+// 他人のリソースへのアクセス拒否などを記録する監査ログ
+var auditLogger = slog.New(slog.NewJSONHandler(os.Stderr, nil)).With("log", "audit")
+
+// authMiddleware
+// ルートが必要とする役割ごとに Cookie のアクセストークンを検証し、主体に加える。1つでも欠けていれば 401 を返す
+func authMiddleware(roles ...Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			principal := &Principal{}
+			if current := principalFromContext(ctx); current != nil {
+				*principal = *current
+			}
+			for _, role := range roles {
+				if err := authenticate(r, role, principal); err != nil {
+					writeError(w, http.StatusUnauthorized, err)
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(ctx, principal)))
+		})
+	}
+}
+
+// authenticate
+// 役割に対応する Cookie のアクセストークンから主体を解決して principal に設定する
+func authenticate(r *http.Request, role Role, principal *Principal) error {
+	cookieName := sessionCookieNames[role]
+	c, err := r.Cookie(cookieName)
+	if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
+		return fmt.Errorf("%s cookie is required", cookieName)
+	}
+	session := resolveSession(c.Value)
+	if session == nil || session.PrincipalType != string(role) {
+		return errors.New("invalid access token")
+	}
+
+	// 署名付きトークンは他のサーバーで発行されたものもあるので、手元に無ければ DB から読んでメモリに載せる
+	ctx := r.Context()
+	switch role {
+	case RoleUser:
+		principal.User = GetUser(session.PrincipalID)
+		if principal.User == nil && signer != nil {
+			principal.User, err = loadUser(ctx, session.PrincipalID)
+		}
+	case RoleOwner:
+		principal.Owner = GetOwner(session.PrincipalID)
+		if principal.Owner == nil && signer != nil {
+			principal.Owner, err = loadOwner(ctx, session.PrincipalID)
+		}
+	case RoleChair:
+		principal.Chair = chairRepository.Get(session.PrincipalID)
+		if principal.Chair == nil && signer != nil {
+			principal.Chair, err = loadChair(ctx, session.PrincipalID)
+		}
+		// 引退した椅子は資格情報が残っていても認証しない
+		if principal.Chair != nil && principal.Chair.RetiredAt != nil {
+			return errChairRetired
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !principal.Has(role) {
+		return errors.New("invalid access token")
+	}
+	return nil
+}
+
+// loadUser
+// メモリに無いユーザーを DB から読んでメモリに載せる。存在しなければ nil を返す
+func loadUser(ctx context.Context, id string) (*User, error) {
+	user := &User{}
+	if err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	UpdateUser(user)
+	return user, nil
+}
+
+// loadOwner
+// メモリに無いオーナーを DB から読んでメモリに載せる。存在しなければ nil を返す
+func loadOwner(ctx context.Context, id string) (*Owner, error) {
+	owner := &Owner{}
+	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	UpdateOwner(owner)
+	return owner, nil
+}
+
+// loadChair
+// メモリに無い椅子を DB から読んでメモリに載せる。存在しなければ nil を返す
+func loadChair(ctx context.Context, id string) (*Chair, error) {
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	chairRepository.Put(chair)
+	return chairRepository.Get(id), nil
+}
+
+// internalOnlyMiddleware
+// インスタンス内からのリクエストだけを通す。nginx の /api/ を経由したリクエストは X-Real-IP にクライアントの IP が入る
+func internalOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackAddr(r.RemoteAddr) || (r.Header.Get("X-Real-IP") != "" && !isLoopbackAddr(r.Header.Get("X-Real-IP"))) {
+			auditLogger.Warn("internal access denied",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"remote_addr", r.RemoteAddr,
+				"real_ip", r.Header.Get("X-Real-IP"),
+			)
+			writeError(w, http.StatusForbidden, errors.New("internal endpoint"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackAddr
+// host:port か IP だけの文字列がループバックアドレスかどうか
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ownerChairMiddleware
+// オーナーがパスの chair_id の自分の椅子として操作できるように、主体に椅子を加える。他人の椅子なら 404 を返す
+func ownerChairMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		c, err := r.Cookie("app_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("app_session cookie is required"))
+		owner, ok := requireOwner(w, r)
+		if !ok {
 			return
 		}
-		accessToken := c.Value
-		user := &User{}
-		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-				return
+		chairID := r.PathValue("chair_id")
+		chair := chairRepository.Get(chairID)
+		if chair == nil || chair.OwnerID != owner.ID {
+			if chair != nil {
+				auditLogger.Warn("chair access denied",
+					"principal_type", RoleOwner,
+					"principal_id", owner.ID,
+					"chair_id", chairID,
+					"method", r.Method,
+					"path", r.URL.Path,
+					"remote_addr", r.RemoteAddr,
+				)
 			}
-			writeError(w, http.StatusInternalServerError, err)
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
 			return
 		}
 
-		ctx = context.WithValue(ctx, "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		principal := *principalFromContext(ctx)
+		principal.Chair = chair
+		next.ServeHTTP(w, r.WithContext(withPrincipal(ctx, &principal)))
 	})
 }
 
-func ownerAuthMiddleware(next http.Handler) http.Handler {
+// appRideAccessMiddleware
+// パスの ride_id のライドが認証済みユーザーのものでなければ 404 を返す
+func appRideAccessMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		c, err := r.Cookie("owner_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("owner_session cookie is required"))
+		user, ok := requireUser(w, r)
+		if !ok {
 			return
 		}
-		accessToken := c.Value
-		owner := &Owner{}
-		if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-				return
-			}
-			writeError(w, http.StatusInternalServerError, err)
+		if !authorizeRideAccess(w, r, RoleUser, user.ID, func(ride *Ride) bool {
+			return ride.UserID == user.ID
+		}) {
 			return
 		}
-
-		ctx = context.WithValue(ctx, "owner", owner)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
 
-func chairAuthMiddleware(next http.Handler) http.Handler {
+// chairRideAccessMiddleware
+// パスの ride_id のライドが認証済みの椅子に割り当てられていなければ 404 を返す
+func chairRideAccessMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		c, err := r.Cookie("chair_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("chair_session cookie is required"))
+		chair, ok := requireChair(w, r)
+		if !ok {
 			return
 		}
-		accessToken := c.Value
-		chair := GetChair(accessToken)
-		if chair == nil {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		if !authorizeRideAccess(w, r, RoleChair, chair.ID, func(ride *Ride) bool {
+			return ride.ChairID.Valid && ride.ChairID.String == chair.ID
+		}) {
 			return
 		}
-
-		ctx = context.WithValue(ctx, "chair", chair)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
+
+// authorizeRideAccess
+// ライドの存在を隠すため、他人のライドへのアクセスも存在しないライドと同じ 404 にし、拒否したことは監査ログに残す
+func authorizeRideAccess(w http.ResponseWriter, r *http.Request, principalType Role, principalID string, allowed func(ride *Ride) bool) bool {
+	rideID := r.PathValue("ride_id")
+	ride := &Ride{}
+	if err := db.GetContext(r.Context(), ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return false
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if !allowed(ride) {
+		auditLogger.Warn("ride access denied",
+			"principal_type", principalType,
+			"principal_id", principalID,
+			"ride_id", rideID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+		)
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInternalOnlyMiddleware(t *testing.T) {
+	handler := internalOnlyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       int
+	}{
+		{name: "localhost", remoteAddr: "127.0.0.1:54321", want: http.StatusNoContent},
+		{name: "localhost ipv6", remoteAddr: "[::1]:54321", want: http.StatusNoContent},
+		{name: "nginx from localhost", remoteAddr: "127.0.0.1:54321", realIP: "127.0.0.1", want: http.StatusNoContent},
+		{name: "proxied from outside", remoteAddr: "127.0.0.1:54321", realIP: "203.0.113.1", want: http.StatusForbidden},
+		{name: "direct from outside", remoteAddr: "203.0.113.1:54321", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/internal/chair-distances/check", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
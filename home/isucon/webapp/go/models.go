@@ -6,14 +6,37 @@ import (
 )
 
 type Chair struct {
-	ID          string    `db:"id"`
-	OwnerID     string    `db:"owner_id"`
-	Name        string    `db:"name"`
-	Model       string    `db:"model"`
-	IsActive    bool      `db:"is_active"`
-	AccessToken string    `db:"access_token"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	ID              string         `db:"id"`
+	OwnerID         string         `db:"owner_id"`
+	Name            string         `db:"name"`
+	Model           string         `db:"model"`
+	IsActive        bool           `db:"is_active"`
+	AccessToken     string         `db:"access_token"`
+	RegisterTokenID sql.NullString `db:"register_token_id"`
+	RetiredAt       *time.Time     `db:"retired_at"`
+	CreatedAt       time.Time      `db:"created_at"`
+	UpdatedAt       time.Time      `db:"updated_at"`
+	// chairRepository に載せたときの索引の版
+	Version uint64 `db:"-"`
+}
+
+type ChairActivity struct {
+	ID        string    `db:"id"`
+	ChairID   string    `db:"chair_id"`
+	IsActive  bool      `db:"is_active"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type ChairStats struct {
+	ChairID       string    `db:"chair_id"`
+	TotalRides    int       `db:"total_rides"`
+	EvaluationSum int       `db:"evaluation_sum"`
+	Evaluation1   int       `db:"evaluation_1"`
+	Evaluation2   int       `db:"evaluation_2"`
+	Evaluation3   int       `db:"evaluation_3"`
+	Evaluation4   int       `db:"evaluation_4"`
+	Evaluation5   int       `db:"evaluation_5"`
+	UpdatedAt     time.Time `db:"updated_at"`
 }
 
 type ChairModel struct {
@@ -30,9 +53,9 @@ type ChairLocation struct {
 }
 
 type ChairTotalDistance struct {
-	ID       string `db:"id"`
-	ChairID  string `db:"chair_id"`
-	Distance int    `db:"distance"`
+	ChairID       string    `db:"chair_id"`
+	TotalDistance int       `db:"total_distance"`
+	UpdatedAt     time.Time `db:"updated_at"`
 }
 
 type User struct {
@@ -62,10 +85,32 @@ type Ride struct {
 	DestinationLatitude  int            `db:"destination_latitude"`
 	DestinationLongitude int            `db:"destination_longitude"`
 	Evaluation           *int           `db:"evaluation"`
+	ScheduledAt          *time.Time     `db:"scheduled_at"`
+	Pooled               bool           `db:"pooled"`
+	PoolID               sql.NullString `db:"pool_id"`
+	Sale                 *int           `db:"sale"`
+	Discount             *int           `db:"discount"`
+	CommissionRate       *int           `db:"commission_rate"`
+	Commission           *int           `db:"commission"`
+	Payout               *int           `db:"payout"`
+	CompletedAt          *time.Time     `db:"completed_at"`
+	OwnerID              sql.NullString `db:"owner_id"`
+	Model                sql.NullString `db:"model"`
+	CanceledAt           *time.Time     `db:"canceled_at"`
+	AssignedAt           *time.Time     `db:"assigned_at"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
 }
 
+type RideWaypoint struct {
+	ID        string     `db:"id"`
+	RideID    string     `db:"ride_id"`
+	Seq       int        `db:"seq"`
+	Latitude  int        `db:"latitude"`
+	Longitude int        `db:"longitude"`
+	ArrivedAt *time.Time `db:"arrived_at"`
+}
+
 type RideStatus struct {
 	ID          string     `db:"id"`
 	RideID      string     `db:"ride_id"`
@@ -75,13 +120,51 @@ type RideStatus struct {
 	ChairSentAt *time.Time `db:"chair_sent_at"`
 }
 
+type RideFeedback struct {
+	RideID     string    `db:"ride_id"`
+	ChairID    string    `db:"chair_id"`
+	Evaluation int       `db:"evaluation"`
+	Comment    *string   `db:"comment"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type RideFeedbackTag struct {
+	RideID     string `db:"ride_id"`
+	ChairID    string `db:"chair_id"`
+	Tag        string `db:"tag"`
+	Evaluation int    `db:"evaluation"`
+}
+
 type Owner struct {
-	ID                 string    `db:"id"`
-	Name               string    `db:"name"`
-	AccessToken        string    `db:"access_token"`
-	ChairRegisterToken string    `db:"chair_register_token"`
-	CreatedAt          time.Time `db:"created_at"`
-	UpdatedAt          time.Time `db:"updated_at"`
+	ID          string    `db:"id"`
+	Name        string    `db:"name"`
+	AccessToken string    `db:"access_token"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+type ChairRegisterToken struct {
+	ID               string     `db:"id"`
+	OwnerID          string     `db:"owner_id"`
+	Token            string     `db:"token"`
+	ExpiresAt        *time.Time `db:"expires_at"`
+	MaxChairs        *int       `db:"max_chairs"`
+	RegisteredChairs int        `db:"registered_chairs"`
+	RevokedAt        *time.Time `db:"revoked_at"`
+	CreatedAt        time.Time  `db:"created_at"`
+}
+
+type Session struct {
+	Token         string    `db:"token"`
+	PrincipalType string    `db:"principal_type"`
+	PrincipalID   string    `db:"principal_id"`
+	CreatedAt     time.Time `db:"created_at"`
+	ExpiresAt     time.Time `db:"expires_at"`
+}
+
+type RevokedToken struct {
+	JTI       string    `db:"jti"`
+	ExpiresAt time.Time `db:"expires_at"`
 }
 
 type Coupon struct {
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
 	"net/http"
 	"strconv"
@@ -13,6 +12,8 @@ import (
 const (
 	initialFare     = 500
 	farePerDistance = 100
+	// 相乗りライドの距離料金の割合(%)
+	pooledFareRate = 80
 )
 
 type ownerPostOwnersRequest struct {
@@ -37,46 +38,71 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ownerID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
-	chairRegisterToken := secureRandomStr(32)
+	session := newSession("owner", ownerID, ownerSessionTTL)
+	// 最初の椅子登録トークンは有効期限も登録数の上限も無い
+	chairRegisterToken := newChairRegisterToken(ownerID, nil, nil)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
 		ctx,
-		"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)",
-		ownerID, req.Name, accessToken, chairRegisterToken,
+		"INSERT INTO owners (id, name, access_token) VALUES (?, ?, ?)",
+		ownerID, req.Name, session.Token,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if err := insertChairRegisterToken(ctx, tx, chairRegisterToken); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertSession(ctx, tx, session); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Path:  "/",
-		Name:  "owner_session",
-		Value: accessToken,
-	})
+	owner := &Owner{}
+	if err := tx.GetContext(ctx, owner, "SELECT * FROM owners WHERE id = ?", ownerID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	UpdateOwner(owner)
+	StoreSession(session)
+
+	setSessionCookie(w, r, "owner_session", session)
 
 	writeJSON(w, http.StatusCreated, &ownerPostOwnersResponse{
 		ID:                 ownerID,
-		ChairRegisterToken: chairRegisterToken,
+		ChairRegisterToken: chairRegisterToken.Token,
 	})
 }
 
 type chairSales struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Sales int    `json:"sales"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	salesBreakdown
 }
 
 type modelSales struct {
 	Model string `json:"model"`
-	Sales int    `json:"sales"`
+	salesBreakdown
 }
 
 type ownerGetSalesResponse struct {
-	TotalSales int          `json:"total_sales"`
-	Chairs     []chairSales `json:"chairs"`
-	Models     []modelSales `json:"models"`
+	salesTotals
+	Chairs []chairSales `json:"chairs"`
+	Models []modelSales `json:"models"`
 }
 
 func ownerGetSales(w http.ResponseWriter, r *http.Request) {
@@ -100,80 +126,27 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		until = time.UnixMilli(parsed)
 	}
 
-	owner := r.Context().Value("owner").(*Owner)
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	owner, ok := requireOwner(w, r)
+	if !ok {
 		return
 	}
-	defer tx.Rollback()
 
-	chairs := []Chair{}
-	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	chairs := chairRepository.ListByOwner(owner.ID)
+	// until はミリ秒の終わりまで含める
+	salesByKey, err := sumOwnerSales(ctx, owner.ID, since, until.Add(time.Millisecond))
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	res := ownerGetSalesResponse{
-		TotalSales: 0,
-	}
-
-	modelSalesByModel := map[string]int{}
-	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		sales := sumSales(rides)
-		res.TotalSales += sales
-
-		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
-		})
-
-		modelSalesByModel[chair.Model] += sales
-	}
-
-	models := []modelSales{}
-	for model, sales := range modelSalesByModel {
-		models = append(models, modelSales{
-			Model: model,
-			Sales: sales,
-		})
-	}
-	res.Models = models
+	res := ownerGetSalesResponse{}
+	res.salesTotals, res.Chairs, res.Models = summarizeSales(chairs, salesByKey, true)
 
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
-	}
-	return sale
-}
-
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-}
-
-type chairWithDetail struct {
-	ID                     string       `db:"id"`
-	OwnerID                string       `db:"owner_id"`
-	Name                   string       `db:"name"`
-	AccessToken            string       `db:"access_token"`
-	Model                  string       `db:"model"`
-	IsActive               bool         `db:"is_active"`
-	CreatedAt              time.Time    `db:"created_at"`
-	UpdatedAt              time.Time    `db:"updated_at"`
-	TotalDistance          int          `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+func calculateSale(ride Ride, waypoints []RideWaypoint) int {
+	return calculatePooledFare(ride.Pooled, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, waypointCoordinates(waypoints)...)
 }
 
 type ownerGetChairResponse struct {
@@ -188,73 +161,109 @@ type ownerGetChairResponseChair struct {
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
+}
+
+func newOwnerGetChairResponseChair(chair *Chair) ownerGetChairResponseChair {
+	totalDistance, totalDistanceUpdatedAt := GetChairTotalDistance(chair.ID)
+	c := ownerGetChairResponseChair{
+		ID:            chair.ID,
+		Name:          chair.Name,
+		Model:         chair.Model,
+		Active:        chair.IsActive,
+		RegisteredAt:  chair.CreatedAt.UnixMilli(),
+		TotalDistance: totalDistance,
+	}
+	if totalDistance > 0 {
+		t := totalDistanceUpdatedAt.UnixMilli()
+		c.TotalDistanceUpdatedAt = &t
+	}
+	if chair.RetiredAt != nil {
+		t := chair.RetiredAt.UnixMilli()
+		c.RetiredAt = &t
+	}
+	return c
 }
 
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	// 椅子の情報はメモリのオーナーごとの索引から引く
+	chairs := chairRepository.ListByOwner(owner.ID)
+
+	res := ownerGetChairResponse{}
+	for _, chair := range chairs {
+		res.Chairs = append(res.Chairs, newOwnerGetChairResponseChair(chair))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPostChairCredentialRevokeResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// 椅子の資格情報をすべて失効させ、椅子に設定し直すための新しい資格情報を発行する。引退済みの椅子には発行しない
+func ownerPostChairCredentialRevoke(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	owner := ctx.Value("owner").(*Owner)
-
-	chairs := []chairWithDetail{}
-	if err := db.SelectContext(ctx, &chairs, `SELECT id,
-       owner_id,
-       name,
-       access_token,
-       model,
-       is_active,
-       created_at,
-       updated_at
-FROM chairs
-WHERE owner_id = ?
-`, owner.ID); err != nil {
+	// 自分の椅子であることは ownerChairMiddleware で確認済み
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
 
-	chairIDs := make([]string, 0, len(chairs))
-	for _, chair := range chairs {
-		chairIDs = append(chairIDs, chair.ID)
+	// 同時に引退させられても新しい資格情報が残らないように、椅子の行をロックしてから確かめる
+	var retiredAt *time.Time
+	if err := tx.GetContext(ctx, &retiredAt, "SELECT retired_at FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if retiredAt != nil {
+		writeError(w, http.StatusConflict, errChairRetired)
+		return
 	}
 
-	totalDistanceByChairID := make(map[string]int)
-	for _, c := range chairs {
-		locations := ListChairLocations(c.ID)
-		var (
-			prev     *ChairLocation
-			distance int
-		)
-		for _, l := range locations {
-			if prev == nil {
-				prev = l
-				continue
-			}
-
-			lat := abs(l.Latitude - prev.Latitude)
-
-			lon := abs(l.Longitude - prev.Longitude)
-
-			distance += lat + lon
-			prev = l
-		}
-		totalDistanceByChairID[c.ID] = distance
+	revocations := &tokenRevocations{}
+	if err := deletePrincipalSessions(ctx, tx, revocations, string(RoleChair), chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	session := newSession(string(RoleChair), chair.ID, chairSessionTTL)
+	if err := insertSession(ctx, tx, session); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 登録時と同じく chairs.access_token にも今の資格情報を持たせ、失効したトークンを残さない
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET access_token = ?, updated_at = ? WHERE id = ?", session.Token, now, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	res := ownerGetChairResponse{}
-	for _, chair := range chairs {
-		totalDistance := totalDistanceByChairID[chair.ID]
-		chairLocation := GetChairLocation(chair.ID)
-		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: totalDistance,
-		}
-		if totalDistance > 0 {
-			t := chairLocation.CreatedAt.UnixMilli()
-			c.TotalDistanceUpdatedAt = &t
-		}
-		res.Chairs = append(res.Chairs, c)
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-	writeJSON(w, http.StatusOK, res)
+	revocations.Apply()
+	InvalidatePrincipalSessions(string(RoleChair), chair.ID)
+	StoreSession(session)
+	chairRepository.Update(chair.ID, func(c *Chair) {
+		c.AccessToken = session.Token
+		c.UpdatedAt = now
+	})
+
+	writeJSON(w, http.StatusOK, &ownerPostChairCredentialRevokeResponse{
+		AccessToken: session.Token,
+		ExpiresAt:   session.ExpiresAt.UnixMilli(),
+	})
 }
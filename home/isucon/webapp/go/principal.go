@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Role
+// 認証済みの主体が持つ役割。セッションの principal_type と同じ値を使う
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleOwner Role = "owner"
+	RoleChair Role = "chair"
+)
+
+// 役割ごとのアクセストークンを持つ Cookie 名
+var sessionCookieNames = map[Role]string{
+	RoleUser:  "app_session",
+	RoleOwner: "owner_session",
+	RoleChair: "chair_session",
+}
+
+var errUnauthenticated = errors.New("authentication is required")
+
+// Principal
+// 認証済みの主体。オーナーが自分の椅子を操作するときのように、複数の役割を同時に持てる
+type Principal struct {
+	User  *User
+	Owner *Owner
+	Chair *Chair
+}
+
+// Has
+// 指定した役割を持っているかどうか
+func (p *Principal) Has(role Role) bool {
+	if p == nil {
+		return false
+	}
+	switch role {
+	case RoleUser:
+		return p.User != nil
+	case RoleOwner:
+		return p.Owner != nil
+	case RoleChair:
+		return p.Chair != nil
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// principalFromContext
+// リクエストの主体を取得する。認証ミドルウェアを通っていなければ nil
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return p
+}
+
+func userFromContext(ctx context.Context) (*User, bool) {
+	p := principalFromContext(ctx)
+	if !p.Has(RoleUser) {
+		return nil, false
+	}
+	return p.User, true
+}
+
+func ownerFromContext(ctx context.Context) (*Owner, bool) {
+	p := principalFromContext(ctx)
+	if !p.Has(RoleOwner) {
+		return nil, false
+	}
+	return p.Owner, true
+}
+
+func chairFromContext(ctx context.Context) (*Chair, bool) {
+	p := principalFromContext(ctx)
+	if !p.Has(RoleChair) {
+		return nil, false
+	}
+	return p.Chair, true
+}
+
+// requireUser
+// 認証済みのユーザーを取得する。取得できなければ 401 を書き込んで false を返す
+func requireUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errUnauthenticated)
+	}
+	return user, ok
+}
+
+// requireOwner
+// 認証済みのオーナーを取得する。取得できなければ 401 を書き込んで false を返す
+func requireOwner(w http.ResponseWriter, r *http.Request) (*Owner, bool) {
+	owner, ok := ownerFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errUnauthenticated)
+	}
+	return owner, ok
+}
+
+// requireChair
+// 認証済みの椅子を取得する。取得できなければ 401 を書き込んで false を返す
+func requireChair(w http.ResponseWriter, r *http.Request) (*Chair, bool) {
+	chair, ok := chairFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errUnauthenticated)
+	}
+	return chair, ok
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 使われなくなったバケツを掃除する間隔
+const rateLimitSweepInterval = time.Minute
+
+var errRateLimited = errors.New("too many requests")
+
+// rateLimit
+// 1秒あたりに補充されるトークン数と、バケツに貯められるトークンの上限。ゼロ値は制限しないことを表す
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l rateLimit) disabled() bool {
+	return l.Rate == 0
+}
+
+// ルートグループごとの制限の既定値。ISUCON_RATE_LIMIT_<GROUP>="rate,burst" で上書きできる
+var (
+	// 未認証の登録系は IP ごとに制限する。ベンチマーカーは1つの IP から登録を続けるので、その速さは通して一斉登録だけを止める
+	signupRateLimit = rateLimit{Rate: 50, Burst: 200}
+	// ライドの作成や運賃の見積もりは利用者のアクセストークンごとに制限する
+	appRateLimit = rateLimit{Rate: 10, Burst: 30}
+	// 椅子は RetryAfterMs ごとに通知を取りに来る間にも位置情報を送るので、その間隔で溜まる分をバーストとして許す
+	chairRateLimit = rateLimit{Rate: 20, Burst: 20 * float64(RetryAfterMs) / 1000}
+)
+
+// loadRateLimit
+// 環境変数からルートグループの制限を読み込む。未設定なら既定値を使う
+func loadRateLimit(group string, def rateLimit) rateLimit {
+	name := "ISUCON_RATE_LIMIT_" + strings.ToUpper(group)
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	rateStr, burstStr, ok := strings.Cut(v, ",")
+	if !ok {
+		panic(fmt.Sprintf("malformed %s: %q", name, v))
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+	if err != nil || rate <= 0 {
+		panic(fmt.Sprintf("malformed rate in %s: %q", name, v))
+	}
+	burst, err := strconv.ParseFloat(strings.TrimSpace(burstStr), 64)
+	if err != nil || burst < 1 {
+		panic(fmt.Sprintf("malformed burst in %s: %q", name, v))
+	}
+	return rateLimit{Rate: rate, Burst: burst}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter
+// キーごとのトークンバケツ。minRetryAfter はクライアントに待たせる最短時間
+type rateLimiter struct {
+	name          string
+	limit         rateLimit
+	minRetryAfter time.Duration
+	buckets       sync.Map
+}
+
+func newRateLimiter(name string, def rateLimit, minRetryAfter time.Duration) *rateLimiter {
+	l := &rateLimiter{
+		name:          name,
+		limit:         loadRateLimit(name, def),
+		minRetryAfter: minRetryAfter,
+	}
+	if !l.limit.disabled() {
+		go l.sweep()
+	}
+	return l
+}
+
+// allow
+// トークンを1つ消費できればリクエストを通す。通せないときは次にトークンが貯まるまでの時間を返す
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	v, _ := l.buckets.LoadOrStore(key, &tokenBucket{tokens: l.limit.Burst, last: now})
+	b := v.(*tokenBucket)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(l.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, max(wait, l.minRetryAfter)
+}
+
+// 満タンまで回復したバケツは作り直しても同じなので削除する
+func (l *rateLimiter) sweep() {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	for now := range ticker.C {
+		l.buckets.Range(func(key, value any) bool {
+			b := value.(*tokenBucket)
+			b.mu.Lock()
+			idle := now.Sub(b.last).Seconds()*l.limit.Rate+b.tokens >= l.limit.Burst
+			b.mu.Unlock()
+			if idle {
+				l.buckets.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// rateLimitMiddleware
+// keyFunc で決めたキーごとにリクエストを制限し、超えたら Retry-After 付きの 429 を返す
+func rateLimitMiddleware(l *rateLimiter, keyFunc func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l.limit.disabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFunc(r)
+			ok, retryAfter := l.allow(key, time.Now())
+			if !ok {
+				slog.Warn("rate limited", "limiter", l.name, "path", r.URL.Path, "retry_after", retryAfter)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, errRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitByToken
+// 役割の Cookie のアクセストークンをキーにする。Cookie が無ければ IP で制限する
+func rateLimitByToken(role Role) func(r *http.Request) string {
+	cookieName := sessionCookieNames[role]
+	return func(r *http.Request) string {
+		if c, err := r.Cookie(cookieName); err == nil && c.Value != "" {
+			return "token:" + c.Value
+		}
+		return rateLimitByIP(r)
+	}
+}
+
+// rateLimitByIP
+// 同じホストの nginx を経由したリクエストは X-Real-IP をクライアントの IP とみなす
+func rateLimitByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			host = realIP
+		}
+	}
+	return "ip:" + host
+}
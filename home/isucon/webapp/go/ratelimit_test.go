@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2024, 12, 8, 0, 0, 0, 0, time.UTC)
+	// 1秒に2つ補充、3つまで貯まる
+	limit := rateLimit{Rate: 2, Burst: 3}
+
+	type call struct {
+		key       string
+		at        time.Duration
+		ok        bool
+		wantRetry time.Duration
+	}
+	tests := []struct {
+		name          string
+		minRetryAfter time.Duration
+		calls         []call
+	}{
+		{
+			name: "burst then refill",
+			calls: []call{
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: false, wantRetry: 500 * time.Millisecond},
+				{key: "a", at: 250 * time.Millisecond, ok: false, wantRetry: 250 * time.Millisecond},
+				{key: "a", at: 500 * time.Millisecond, ok: true},
+				{key: "a", at: 500 * time.Millisecond, ok: false, wantRetry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "refill is capped at burst",
+			calls: []call{
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: time.Hour, ok: true},
+				{key: "a", at: time.Hour, ok: true},
+				{key: "a", at: time.Hour, ok: true},
+				{key: "a", at: time.Hour, ok: false, wantRetry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "keys have separate buckets",
+			calls: []call{
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: false, wantRetry: 500 * time.Millisecond},
+				{key: "b", at: 0, ok: true},
+			},
+		},
+		{
+			name:          "retry after is at least the minimum",
+			minRetryAfter: 1500 * time.Millisecond,
+			calls: []call{
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: true},
+				{key: "a", at: 0, ok: false, wantRetry: 1500 * time.Millisecond},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{name: "test", limit: limit, minRetryAfter: tt.minRetryAfter}
+			for i, c := range tt.calls {
+				ok, retryAfter := l.allow(c.key, start.Add(c.at))
+				if ok != c.ok || retryAfter != c.wantRetry {
+					t.Fatalf("call %d: allow(%q, +%v) = (%v, %v), want (%v, %v)", i, c.key, c.at, ok, retryAfter, c.ok, c.wantRetry)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitDefaults(t *testing.T) {
+	if signupRateLimit.disabled() || appRateLimit.disabled() || chairRateLimit.disabled() {
+		t.Fatalf("every rate limit must be enabled by default")
+	}
+	if !(rateLimit{}).disabled() {
+		t.Fatalf("the zero value must disable the limit")
+	}
+}
+
+func TestRateLimitMiddlewareSignup(t *testing.T) {
+	l := &rateLimiter{name: "signup", limit: rateLimit{Rate: 1, Burst: 1}}
+	handler := rateLimitMiddleware(l, rateLimitByIP)(http.HandlerFunc(appPostUsers))
+
+	post := func(remoteAddr string) *httptest.ResponseRecorder {
+		// 不正な JSON なので、制限を通れば DB に触れずに 400 を返す
+		req := httptest.NewRequest(http.MethodPost, "/api/app/users", strings.NewReader("{"))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("192.0.2.1:1234"); w.Code != http.StatusBadRequest {
+		t.Fatalf("first request must reach appPostUsers, got %d", w.Code)
+	}
+	w := post("192.0.2.1:1235")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request must be rate limited, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("unexpected Retry-After: %q", got)
+	}
+	if w := post("192.0.2.2:1234"); w.Code != http.StatusBadRequest {
+		t.Fatalf("another IP must not be limited, got %d", w.Code)
+	}
+}
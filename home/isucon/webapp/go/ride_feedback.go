@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 評価に付けられるコメントの最大文字数
+	rideFeedbackCommentMaxLength = 500
+	// オーナーに返すフィードバックの件数の既定値と上限
+	rideFeedbackDefaultLimit = 20
+	rideFeedbackMaxLimit     = 100
+)
+
+// 評価に付けられる理由のタグ。並び順は集計の返す順になる
+var rideFeedbackTags = []string{"cleanliness", "comfort", "speed", "route"}
+
+var errRideAlreadyEvaluated = errors.New("ride is already evaluated")
+
+// normalizeRideFeedbackTags
+// 既定のタグ以外を拒否し、重複を除いて rideFeedbackTags の順に並べる
+func normalizeRideFeedbackTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range rideFeedbackTags {
+		if slices.Contains(tags, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	for _, tag := range tags {
+		if !slices.Contains(rideFeedbackTags, tag) {
+			return nil, fmt.Errorf("unknown tag: %s", tag)
+		}
+	}
+	return normalized, nil
+}
+
+// recordRideFeedback
+// 評価の理由のタグとコメントを記録する。どちらも無ければ何もしない。ライドを完了させるトランザクションの中で呼ぶ
+func recordRideFeedback(ctx context.Context, tx *sqlx.Tx, rideID, chairID string, evaluation int, tags []string, comment string) error {
+	if len(tags) == 0 && comment == "" {
+		return nil
+	}
+	var c *string
+	if comment != "" {
+		c = &comment
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO ride_feedbacks (ride_id, chair_id, evaluation, comment) VALUES (?, ?, ?, ?)", rideID, chairID, evaluation, c); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_feedback_tags (ride_id, chair_id, tag, evaluation) VALUES (?, ?, ?, ?)", rideID, chairID, tag, evaluation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ownerGetChairFeedbackResponse struct {
+	ChairID  string                      `json:"chair_id"`
+	Tags     []ownerGetChairFeedbackTag  `json:"tags"`
+	Feedback []ownerGetChairFeedbackItem `json:"feedback"`
+}
+
+type ownerGetChairFeedbackTag struct {
+	Tag           string  `json:"tag"`
+	Count         int     `json:"count"`
+	AvgEvaluation float64 `json:"avg_evaluation"`
+}
+
+type ownerGetChairFeedbackItem struct {
+	RideID     string   `json:"ride_id"`
+	Evaluation int      `json:"evaluation"`
+	Tags       []string `json:"tags"`
+	Comment    *string  `json:"comment"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+type rideFeedbackTagSummary struct {
+	Tag           string  `db:"tag"`
+	Count         int     `db:"count"`
+	AvgEvaluation float64 `db:"avg_evaluation"`
+}
+
+// オーナーの椅子に付いた評価の理由の集計と、新しい順のフィードバック
+// before(ミリ秒)より前のものを limit 件返す
+func ownerGetChairFeedback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// 自分の椅子であることは ownerChairMiddleware で確認済み
+	chair, ok := requireChair(w, r)
+	if !ok {
+		return
+	}
+
+	limit := rideFeedbackDefaultLimit
+	if r.URL.Query().Get("limit") != "" {
+		parsed, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || parsed <= 0 || parsed > rideFeedbackMaxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", rideFeedbackMaxLimit))
+			return
+		}
+		limit = parsed
+	}
+	before := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	if r.URL.Query().Get("before") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		before = time.UnixMilli(parsed)
+	}
+
+	summaries := []rideFeedbackTagSummary{}
+	if err := db.SelectContext(ctx, &summaries, `SELECT tag, COUNT(*) AS count, AVG(evaluation) AS avg_evaluation
+FROM ride_feedback_tags
+WHERE chair_id = ?
+GROUP BY tag`, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	feedbacks := []RideFeedback{}
+	if err := db.SelectContext(ctx, &feedbacks, `SELECT *
+FROM ride_feedbacks
+WHERE chair_id = ?
+  AND created_at < ?
+ORDER BY created_at DESC, ride_id DESC
+LIMIT ?`, chair.ID, before, limit); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tagsByRideID := map[string][]string{}
+	if len(feedbacks) > 0 {
+		rideIDs := make([]string, 0, len(feedbacks))
+		for _, feedback := range feedbacks {
+			rideIDs = append(rideIDs, feedback.RideID)
+		}
+		query, args, err := sqlx.In("SELECT * FROM ride_feedback_tags WHERE ride_id IN (?)", rideIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tags := []RideFeedbackTag{}
+		if err := db.SelectContext(ctx, &tags, query, args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, tag := range tags {
+			tagsByRideID[tag.RideID] = append(tagsByRideID[tag.RideID], tag.Tag)
+		}
+	}
+
+	res := ownerGetChairFeedbackResponse{
+		ChairID:  chair.ID,
+		Tags:     make([]ownerGetChairFeedbackTag, 0, len(rideFeedbackTags)),
+		Feedback: make([]ownerGetChairFeedbackItem, 0, len(feedbacks)),
+	}
+	// 一度も付いていないタグも 0 件として返す
+	for _, tag := range rideFeedbackTags {
+		t := ownerGetChairFeedbackTag{Tag: tag}
+		for _, summary := range summaries {
+			if summary.Tag == tag {
+				t.Count = summary.Count
+				t.AvgEvaluation = summary.AvgEvaluation
+			}
+		}
+		res.Tags = append(res.Tags, t)
+	}
+	for _, feedback := range feedbacks {
+		tags, _ := normalizeRideFeedbackTags(tagsByRideID[feedback.RideID])
+		res.Feedback = append(res.Feedback, ownerGetChairFeedbackItem{
+			RideID:     feedback.RideID,
+			Evaluation: feedback.Evaluation,
+			Tags:       tags,
+			Comment:    feedback.Comment,
+			CreatedAt:  feedback.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// validateRideFeedbackComment
+// コメントの長さを文字数で確かめる
+func validateRideFeedbackComment(comment string) error {
+	if utf8.RuneCountInString(comment) > rideFeedbackCommentMaxLength {
+		return fmt.Errorf("comment must be at most %d characters", rideFeedbackCommentMaxLength)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRideFeedbackTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "nil", tags: nil, want: []string{}},
+		{name: "empty", tags: []string{}, want: []string{}},
+		{name: "single", tags: []string{"speed"}, want: []string{"speed"}},
+		{name: "sorted in the defined order", tags: []string{"route", "cleanliness", "speed"}, want: []string{"cleanliness", "speed", "route"}},
+		{name: "duplicates removed", tags: []string{"comfort", "comfort", "route", "comfort"}, want: []string{"comfort", "route"}},
+		{name: "all", tags: []string{"route", "speed", "comfort", "cleanliness"}, want: []string{"cleanliness", "comfort", "speed", "route"}},
+		{name: "unknown", tags: []string{"speed", "music"}, wantErr: true},
+		{name: "case sensitive", tags: []string{"Speed"}, wantErr: true},
+		{name: "empty string", tags: []string{""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeRideFeedbackTags(tt.tags)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got == nil || !slices.Equal(got, tt.want) {
+				t.Fatalf("normalizeRideFeedbackTags(%v) = %#v, want %#v", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRideFeedbackComment(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment string
+		wantErr bool
+	}{
+		{name: "empty", comment: ""},
+		{name: "at the limit", comment: strings.Repeat("a", rideFeedbackCommentMaxLength)},
+		// 文字数で数えるので、バイト数が上限を超えていても通す
+		{name: "multibyte at the limit", comment: strings.Repeat("あ", rideFeedbackCommentMaxLength)},
+		{name: "over the limit", comment: strings.Repeat("あ", rideFeedbackCommentMaxLength+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRideFeedbackComment(tt.comment); (err != nil) != tt.wantErr {
+				t.Fatalf("validateRideFeedbackComment(%d chars) error = %v, wantErr %v", len([]rune(tt.comment)), err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// RideStatusTransitions
+// ライドの状態遷移表。キーの状態から遷移できる状態を持つ。空文字はライド作成前を表す
+type RideStatusTransitions map[string][]string
+
+var rideStatusTransitions = RideStatusTransitions{
+	"":          {"MATCHING", "SCHEDULED"},
+	"SCHEDULED": {"MATCHING", "CANCELED"},
+	"MATCHING":  {"ENROUTE", "CANCELED"},
+	"ENROUTE":   {"PICKUP", "CANCELED"},
+	"PICKUP":    {"CARRYING"},
+	"CARRYING":  {"WAYPOINT", "ARRIVED"},
+	"WAYPOINT":  {"WAYPOINT", "ARRIVED"},
+	"ARRIVED":   {"COMPLETED"},
+	"COMPLETED": {},
+	"CANCELED":  {},
+}
+
+// 状態遷移が拒否された理由
+const (
+	rideStatusReasonUnknownStatus     = "unknown_status"
+	rideStatusReasonRideFinished      = "ride_finished"
+	rideStatusReasonIllegalTransition = "illegal_transition"
+)
+
+type RideStatusTransitionError struct {
+	RideID string
+	From   string
+	To     string
+	Reason string
+}
+
+func (e *RideStatusTransitionError) Error() string {
+	return fmt.Sprintf("cannot change ride status from %q to %q: %s", e.From, e.To, e.Reason)
+}
+
+// Check
+// from から to への遷移が許されていなければ理由付きのエラーを返す
+func (t RideStatusTransitions) Check(rideID, from, to string) error {
+	if _, ok := t[to]; !ok || to == "" {
+		return &RideStatusTransitionError{RideID: rideID, From: from, To: to, Reason: rideStatusReasonUnknownStatus}
+	}
+	next, ok := t[from]
+	if !ok {
+		return &RideStatusTransitionError{RideID: rideID, From: from, To: to, Reason: rideStatusReasonUnknownStatus}
+	}
+	if len(next) == 0 {
+		return &RideStatusTransitionError{RideID: rideID, From: from, To: to, Reason: rideStatusReasonRideFinished}
+	}
+	if !slices.Contains(next, to) {
+		return &RideStatusTransitionError{RideID: rideID, From: from, To: to, Reason: rideStatusReasonIllegalTransition}
+	}
+	return nil
+}
+
+// transitionRideStatus
+// ライドの状態を遷移表に従って変更する。ride_statuses への書き込みは必ずこれを通す
+// 変更は changes に溜めるので、呼び出し側はコミットした後に changes.Publish を呼ぶ
+func transitionRideStatus(ctx context.Context, tx *sqlx.Tx, changes *rideStatusChanges, rideID, to string) error {
+	from, err := getLatestRideStatus(ctx, tx, rideID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := rideStatusTransitions.Check(rideID, from, to); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), rideID, to); err != nil {
+		return err
+	}
+	// キャンセルされたライドはマッチングの候補から SQL で除けるように rides にも記録する
+	if to == "CANCELED" {
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET canceled_at = CURRENT_TIMESTAMP(6) WHERE id = ?", rideID); err != nil {
+			return err
+		}
+	}
+	return changes.record(ctx, tx, rideID, to, time.Now())
+}
+
+// writeRideStatusError
+// 状態遷移のエラーは 409 と機械可読な理由を、それ以外は 500 を返す
+func writeRideStatusError(w http.ResponseWriter, err error) {
+	var transitionErr *RideStatusTransitionError
+	if !errors.As(err, &transitionErr) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusConflict)
+	buf, marshalError := json.Marshal(map[string]string{
+		"message": transitionErr.Error(),
+		"reason":  transitionErr.Reason,
+		"from":    transitionErr.From,
+		"to":      transitionErr.To,
+	})
+	if marshalError != nil {
+		w.Write([]byte(`{"error":"marshaling error failed"}`))
+		return
+	}
+	w.Write(buf)
+
+	slog.Error("error response wrote", "error", err)
+}
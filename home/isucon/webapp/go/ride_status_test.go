@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRideStatusTransitionsCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		to     string
+		reason string
+	}{
+		{name: "create", from: "", to: "MATCHING"},
+		{name: "create scheduled", from: "", to: "SCHEDULED"},
+		{name: "scheduled to matching", from: "SCHEDULED", to: "MATCHING"},
+		{name: "cancel scheduled", from: "SCHEDULED", to: "CANCELED"},
+		{name: "cancel enroute", from: "ENROUTE", to: "CANCELED"},
+		{name: "waypoint repeats", from: "WAYPOINT", to: "WAYPOINT"},
+		{name: "complete", from: "ARRIVED", to: "COMPLETED"},
+		{name: "unknown to", from: "MATCHING", to: "FLYING", reason: rideStatusReasonUnknownStatus},
+		{name: "empty to", from: "MATCHING", to: "", reason: rideStatusReasonUnknownStatus},
+		{name: "unknown from", from: "FLYING", to: "ARRIVED", reason: rideStatusReasonUnknownStatus},
+		{name: "completed", from: "COMPLETED", to: "MATCHING", reason: rideStatusReasonRideFinished},
+		{name: "canceled", from: "CANCELED", to: "CANCELED", reason: rideStatusReasonRideFinished},
+		{name: "skip pickup", from: "ENROUTE", to: "CARRYING", reason: rideStatusReasonIllegalTransition},
+		{name: "cancel while carrying", from: "CARRYING", to: "CANCELED", reason: rideStatusReasonIllegalTransition},
+		{name: "back to matching", from: "ARRIVED", to: "MATCHING", reason: rideStatusReasonIllegalTransition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rideStatusTransitions.Check("ride1", tt.from, tt.to)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var transitionErr *RideStatusTransitionError
+			if !errors.As(err, &transitionErr) {
+				t.Fatalf("expected RideStatusTransitionError, got %v", err)
+			}
+			if transitionErr.Reason != tt.reason || transitionErr.RideID != "ride1" || transitionErr.From != tt.from || transitionErr.To != tt.to {
+				t.Fatalf("unexpected error: %+v", transitionErr)
+			}
+		})
+	}
+}
+
+// 遷移先に書かれた状態はすべて遷移表のキーにもなっていること
+func TestRideStatusTransitionsClosed(t *testing.T) {
+	for from, next := range rideStatusTransitions {
+		for _, to := range next {
+			if _, ok := rideStatusTransitions[to]; !ok {
+				t.Errorf("%q -> %q: %q is not in the transition table", from, to, to)
+			}
+		}
+	}
+}
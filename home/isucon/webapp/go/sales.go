@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// SQL で売上を集計する時間枠(秒)。どのタイムゾーンの時差も15分単位なので、ここから時間・日・週の区切りに組み直せる
+	salesSlotSeconds = 15 * 60
+	// 時系列の売上で返せる区切りの上限
+	maxSalesTimeseriesBuckets = 2000
+)
+
+// calculateRideSale
+// ライドの売上(割引前の運賃)を計算する
+func calculateRideSale(ctx context.Context, q sqlx.QueryerContext, ride *Ride) (int, error) {
+	waypoints, err := getRideWaypoints(ctx, q, ride.ID)
+	if err != nil {
+		return 0, err
+	}
+	return calculateSale(*ride, waypoints), nil
+}
+
+// backfillRideSettlements
+// 精算額を記録する前に完了したライドの売上・割引額・手数料・支払額と、完了時のオーナーとモデルを書き込む
+// 完了時のオーナーとモデルが記録されていなければ今の椅子の値を使う
+func backfillRideSettlements(ctx context.Context) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rides := []Ride{}
+	if err := tx.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE completed_at IS NOT NULL AND (payout IS NULL OR owner_id IS NULL)"); err != nil {
+		return err
+	}
+	if len(rides) == 0 {
+		return nil
+	}
+	rideIDs := make([]string, 0, len(rides))
+	chairIDs := make([]string, 0, len(rides))
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+		chairIDs = append(chairIDs, ride.ChairID.String)
+	}
+	waypointsByRideID, err := getRideWaypointsByRideIDs(ctx, tx, rideIDs)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM coupons WHERE used_by IN (?)", rideIDs)
+	if err != nil {
+		return err
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, query, args...); err != nil {
+		return err
+	}
+	couponDiscountByRideID := make(map[string]int, len(coupons))
+	for _, coupon := range coupons {
+		couponDiscountByRideID[*coupon.UsedBy] = coupon.Discount
+	}
+
+	query, args, err = sqlx.In("SELECT * FROM chairs WHERE id IN (?)", chairIDs)
+	if err != nil {
+		return err
+	}
+	chairs := []Chair{}
+	if err := tx.SelectContext(ctx, &chairs, query, args...); err != nil {
+		return err
+	}
+	chairByID := make(map[string]Chair, len(chairs))
+	for _, chair := range chairs {
+		chairByID[chair.ID] = chair
+	}
+
+	commissionRates := map[[2]string]int{}
+	for _, ride := range rides {
+		chair := chairByID[ride.ChairID.String]
+		if ride.OwnerID.Valid {
+			chair.OwnerID = ride.OwnerID.String
+		}
+		if ride.Model.Valid {
+			chair.Model = ride.Model.String
+		}
+		key := [2]string{chair.OwnerID, chair.Model}
+		rate, ok := commissionRates[key]
+		if !ok {
+			rate, err = getCommissionRate(ctx, tx, chair.OwnerID, chair.Model)
+			if err != nil {
+				return err
+			}
+			commissionRates[key] = rate
+		}
+
+		sale := calculateSale(ride, waypointsByRideID[ride.ID])
+		if ride.Sale != nil {
+			sale = *ride.Sale
+		}
+		settlement := settleRide(sale, discountFare(sale, couponDiscountByRideID[ride.ID]), rate)
+		if ride.Payout != nil {
+			settlement = rideSettlement{Sale: sale, Discount: *ride.Discount, CommissionRate: *ride.CommissionRate, Commission: *ride.Commission, Payout: *ride.Payout}
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE rides SET sale = ?, discount = ?, commission_rate = ?, commission = ?, payout = ?, owner_id = ?, model = ?, updated_at = updated_at WHERE id = ?",
+			settlement.Sale, settlement.Discount, settlement.CommissionRate, settlement.Commission, settlement.Payout, chair.OwnerID, chair.Model, ride.ID,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type ownerGetSalesTimeseriesResponse struct {
+	Bucket   string                  `json:"bucket"`
+	Timezone string                  `json:"tz"`
+	Buckets  []salesTimeseriesBucket `json:"buckets"`
+}
+
+type salesTimeseriesBucket struct {
+	Start int64 `json:"start"`
+	salesTotals
+	Chairs []chairSales `json:"chairs"`
+	Models []modelSales `json:"models"`
+}
+
+type salesSlot struct {
+	ChairID string `db:"chair_id"`
+	Model   string `db:"model"`
+	Slot    int64  `db:"slot"`
+	salesBreakdown
+}
+
+// truncateSalesBucket
+// 時刻を loc での時間・日・週(月曜始まり)の区切りの先頭に切り捨てる
+func truncateSalesBucket(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch bucket {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+// nextSalesBucket
+// 次の区切りの先頭。夏時間の切り替えがあっても区切りの先頭に揃える
+func nextSalesBucket(start time.Time, bucket string, loc *time.Location) time.Time {
+	switch bucket {
+	case "hour":
+		return truncateSalesBucket(start.Add(time.Hour), bucket, loc)
+	case "week":
+		return truncateSalesBucket(start.AddDate(0, 0, 7), bucket, loc)
+	default:
+		return truncateSalesBucket(start.AddDate(0, 0, 1), bucket, loc)
+	}
+}
+
+// オーナーの売上を時間・日・週ごとに椅子別・モデル別に集計する
+func ownerGetSalesTimeseries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("since") == "" || query.Get("until") == "" {
+		writeError(w, http.StatusBadRequest, errors.New("since and until are required"))
+		return
+	}
+	sinceMs, err := strconv.ParseInt(query.Get("since"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	untilMs, err := strconv.ParseInt(query.Get("until"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	since, until := time.UnixMilli(sinceMs), time.UnixMilli(untilMs)
+	if until.Before(since) {
+		writeError(w, http.StatusBadRequest, errors.New("until must not be before since"))
+		return
+	}
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if bucket != "hour" && bucket != "day" && bucket != "week" {
+		writeError(w, http.StatusBadRequest, errors.New("bucket must be one of hour, day or week"))
+		return
+	}
+	tz := query.Get("tz")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown tz: %s", tz))
+		return
+	}
+
+	// 区切りを先に並べておき、売上の無い区切りも0として返す
+	buckets := []salesTimeseriesBucket{}
+	bucketIndex := map[int64]int{}
+	for start := truncateSalesBucket(since, bucket, loc); !start.After(until); start = nextSalesBucket(start, bucket, loc) {
+		if len(buckets) >= maxSalesTimeseriesBuckets {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("too many buckets: at most %d buckets can be requested", maxSalesTimeseriesBuckets))
+			return
+		}
+		bucketIndex[start.UnixMilli()] = len(buckets)
+		buckets = append(buckets, salesTimeseriesBucket{
+			Start:  start.UnixMilli(),
+			Chairs: []chairSales{},
+			Models: []modelSales{},
+		})
+	}
+
+	chairs := chairRepository.ListByOwner(owner.ID)
+
+	// DATETIME は UTC で保存しているので、セッションのタイムゾーンに依存しない TIMESTAMPDIFF で枠に分ける
+	slots := []salesSlot{}
+	if err := db.SelectContext(ctx, &slots, `SELECT chair_id,
+       model,
+       TIMESTAMPDIFF(SECOND, '1970-01-01 00:00:00', completed_at) DIV ? AS slot,
+       SUM(sale)       AS sales,
+       SUM(discount)   AS discount,
+       SUM(commission) AS commission,
+       SUM(payout)     AS payout
+FROM rides
+WHERE owner_id = ?
+  AND completed_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+GROUP BY chair_id, model, slot`, salesSlotSeconds, owner.ID, since, until); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	salesByBucket := make([]map[chairModelKey]salesBreakdown, len(buckets))
+	for _, slot := range slots {
+		start := truncateSalesBucket(time.Unix(slot.Slot*salesSlotSeconds, 0), bucket, loc)
+		i, ok := bucketIndex[start.UnixMilli()]
+		if !ok {
+			continue
+		}
+		if salesByBucket[i] == nil {
+			salesByBucket[i] = map[chairModelKey]salesBreakdown{}
+		}
+		key := chairModelKey{ChairID: slot.ChairID, Model: slot.Model}
+		sales := salesByBucket[i][key]
+		sales.add(slot.salesBreakdown)
+		salesByBucket[i][key] = sales
+	}
+
+	for i, salesByKey := range salesByBucket {
+		buckets[i].salesTotals, buckets[i].Chairs, buckets[i].Models = summarizeSales(chairs, salesByKey, false)
+	}
+
+	writeJSON(w, http.StatusOK, &ownerGetSalesTimeseriesResponse{
+		Bucket:   bucket,
+		Timezone: loc.String(),
+		Buckets:  buckets,
+	})
+}
+
+// recordSalesDaily
+// 完了したライドの売上を日ごとの集計に足す。ライドを完了させるトランザクションの中で呼ぶ
+func recordSalesDaily(ctx context.Context, tx *sqlx.Tx, rideID string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO sales_daily (owner_id, date, chair_id, model, sales, discount, commission, payout, rides)
+SELECT owner_id, DATE(completed_at), chair_id, model, sale, discount, commission, payout, 1
+FROM rides
+WHERE id = ?
+  AND completed_at IS NOT NULL
+  AND owner_id IS NOT NULL
+ON DUPLICATE KEY UPDATE sales      = sales + VALUES(sales),
+                        discount   = discount + VALUES(discount),
+                        commission = commission + VALUES(commission),
+                        payout     = payout + VALUES(payout),
+                        rides      = rides + VALUES(rides)`, rideID)
+	return err
+}
+
+// rebuildSalesDaily
+// 完了したライドから日ごとの売上の集計を作り直す。オーナーとモデルは今の椅子ではなく完了時に記録した値を使う
+func rebuildSalesDaily(ctx context.Context) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sales_daily"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO sales_daily (owner_id, date, chair_id, model, sales, discount, commission, payout, rides)
+SELECT owner_id,
+       DATE(completed_at),
+       chair_id,
+       model,
+       SUM(sale),
+       SUM(discount),
+       SUM(commission),
+       SUM(payout),
+       COUNT(*)
+FROM rides
+WHERE completed_at IS NOT NULL
+  AND owner_id IS NOT NULL
+GROUP BY owner_id, DATE(completed_at), chair_id, model`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// chairModelKey
+// 売上を集計する単位。椅子のモデルが途中で変わっても、完了したときのモデルごとに分けて持つ
+type chairModelKey struct {
+	ChairID string
+	Model   string
+}
+
+type chairSalesSum struct {
+	ChairID string `db:"chair_id"`
+	Model   string `db:"model"`
+	salesBreakdown
+}
+
+// sumOwnerSales
+// [since, until) にオーナーの椅子として完了したライドの売上を椅子とモデルごとに合計する
+// UTC の日付をまるごと含む部分は sales_daily から、前後の端数の時間だけ rides から集計する
+func sumOwnerSales(ctx context.Context, ownerID string, since, until time.Time) (map[chairModelKey]salesBreakdown, error) {
+	since, until = since.UTC(), until.UTC()
+	firstFullDay := since.Truncate(24 * time.Hour)
+	if firstFullDay.Before(since) {
+		firstFullDay = firstFullDay.AddDate(0, 0, 1)
+	}
+	endFullDay := until.Truncate(24 * time.Hour)
+
+	sums := []chairSalesSum{}
+	addLive := func(from, to time.Time) error {
+		if !from.Before(to) {
+			return nil
+		}
+		rows := []chairSalesSum{}
+		if err := db.SelectContext(ctx, &rows, `SELECT chair_id,
+       model,
+       SUM(sale)       AS sales,
+       SUM(discount)   AS discount,
+       SUM(commission) AS commission,
+       SUM(payout)     AS payout
+FROM rides
+WHERE owner_id = ?
+  AND completed_at >= ?
+  AND completed_at < ?
+GROUP BY chair_id, model`, ownerID, from, to); err != nil {
+			return err
+		}
+		sums = append(sums, rows...)
+		return nil
+	}
+
+	if !firstFullDay.Before(endFullDay) {
+		if err := addLive(since, until); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := addLive(since, firstFullDay); err != nil {
+			return nil, err
+		}
+		rows := []chairSalesSum{}
+		if err := db.SelectContext(ctx, &rows, `SELECT chair_id,
+       model,
+       SUM(sales)      AS sales,
+       SUM(discount)   AS discount,
+       SUM(commission) AS commission,
+       SUM(payout)     AS payout
+FROM sales_daily
+WHERE owner_id = ?
+  AND date >= ?
+  AND date < ?
+GROUP BY chair_id, model`, ownerID, firstFullDay.Format(time.DateOnly), endFullDay.Format(time.DateOnly)); err != nil {
+			return nil, err
+		}
+		sums = append(sums, rows...)
+		if err := addLive(endFullDay, until); err != nil {
+			return nil, err
+		}
+	}
+
+	salesByKey := map[chairModelKey]salesBreakdown{}
+	for _, sum := range sums {
+		key := chairModelKey{ChairID: sum.ChairID, Model: sum.Model}
+		sales := salesByKey[key]
+		sales.add(sum.salesBreakdown)
+		salesByKey[key] = sales
+	}
+	return salesByKey, nil
+}
+
+// 日ごとの売上の集計を作り直す
+func internalPostSalesRebuild(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := backfillRideSettlements(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := rebuildSalesDaily(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// salesTotals
+// 売上の内訳の合計
+type salesTotals struct {
+	TotalSales      int `json:"total_sales"`
+	TotalDiscount   int `json:"total_discount"`
+	TotalCommission int `json:"total_commission"`
+	TotalPayout     int `json:"total_payout"`
+}
+
+// summarizeSales
+// 椅子とモデルごとの売上の内訳から合計と椅子別・モデル別の内訳を作る
+// 譲渡して今は持っていない椅子も、売上があれば含める。withZero なら今の椅子のうち売上の無いものも含める
+func summarizeSales(chairs []*Chair, salesByKey map[chairModelKey]salesBreakdown, withZero bool) (salesTotals, []chairSales, []modelSales) {
+	totals := salesTotals{}
+	salesByChairID := map[string]salesBreakdown{}
+	salesByModel := map[string]salesBreakdown{}
+	for key, sales := range salesByKey {
+		totals.TotalSales += sales.Sales
+		totals.TotalDiscount += sales.Discount
+		totals.TotalCommission += sales.Commission
+		totals.TotalPayout += sales.Payout
+
+		chairTotal := salesByChairID[key.ChairID]
+		chairTotal.add(sales)
+		salesByChairID[key.ChairID] = chairTotal
+
+		modelTotal := salesByModel[key.Model]
+		modelTotal.add(sales)
+		salesByModel[key.Model] = modelTotal
+	}
+
+	names := map[string]string{}
+	for _, chair := range chairs {
+		names[chair.ID] = chair.Name
+		if _, ok := salesByChairID[chair.ID]; !ok && withZero {
+			salesByChairID[chair.ID] = salesBreakdown{}
+			if _, ok := salesByModel[chair.Model]; !ok {
+				salesByModel[chair.Model] = salesBreakdown{}
+			}
+		}
+	}
+
+	chairSalesList := make([]chairSales, 0, len(salesByChairID))
+	for chairID, sales := range salesByChairID {
+		name, ok := names[chairID]
+		if !ok {
+			if chair := chairRepository.Get(chairID); chair != nil {
+				name = chair.Name
+			}
+		}
+		chairSalesList = append(chairSalesList, chairSales{
+			ID:             chairID,
+			Name:           name,
+			salesBreakdown: sales,
+		})
+	}
+	sort.Slice(chairSalesList, func(i, j int) bool {
+		return chairSalesList[i].ID < chairSalesList[j].ID
+	})
+
+	modelSalesList := []modelSales{}
+	for model, sales := range salesByModel {
+		modelSalesList = append(modelSalesList, modelSales{
+			Model:          model,
+			salesBreakdown: sales,
+		})
+	}
+	sort.Slice(modelSalesList, func(i, j int) bool {
+		return modelSalesList[i].Model < modelSalesList[j].Model
+	})
+	return totals, chairSalesList, modelSalesList
+}
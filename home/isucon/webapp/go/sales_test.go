@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestTruncateSalesBucket(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	tests := []struct {
+		name   string
+		t      time.Time
+		bucket string
+		loc    *time.Location
+		want   time.Time
+	}{
+		{
+			name: "hour", bucket: "hour", loc: time.UTC,
+			t:    time.Date(2024, 12, 8, 10, 42, 13, 5, time.UTC),
+			want: time.Date(2024, 12, 8, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day", bucket: "day", loc: time.UTC,
+			t:    time.Date(2024, 12, 8, 23, 59, 59, 0, time.UTC),
+			want: time.Date(2024, 12, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day in another time zone", bucket: "day", loc: tokyo,
+			t:    time.Date(2024, 12, 8, 16, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 12, 9, 0, 0, 0, 0, tokyo),
+		},
+		{
+			name: "week starts on monday", bucket: "week", loc: time.UTC,
+			t:    time.Date(2024, 12, 8, 12, 0, 0, 0, time.UTC), // 日曜日
+			want: time.Date(2024, 12, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "monday is the start of its own week", bucket: "week", loc: time.UTC,
+			t:    time.Date(2024, 12, 9, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 12, 9, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateSalesBucket(tt.t, tt.bucket, tt.loc); !got.Equal(tt.want) {
+				t.Fatalf("truncateSalesBucket(%v, %q) = %v, want %v", tt.t, tt.bucket, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextSalesBucket(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	tests := []struct {
+		name   string
+		start  time.Time
+		bucket string
+		loc    *time.Location
+		want   time.Time
+	}{
+		{
+			name: "hour", bucket: "hour", loc: time.UTC,
+			start: time.Date(2024, 12, 8, 23, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 12, 9, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "day", bucket: "day", loc: time.UTC,
+			start: time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "week", bucket: "week", loc: time.UTC,
+			start: time.Date(2024, 12, 2, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 12, 9, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// 夏時間が始まる日は23時間しかない
+			name: "day across dst start", bucket: "day", loc: newYork,
+			start: time.Date(2024, 3, 10, 0, 0, 0, 0, newYork),
+			want:  time.Date(2024, 3, 11, 0, 0, 0, 0, newYork),
+		},
+		{
+			// 夏時間が終わる日は25時間ある
+			name: "day across dst end", bucket: "day", loc: newYork,
+			start: time.Date(2024, 11, 3, 0, 0, 0, 0, newYork),
+			want:  time.Date(2024, 11, 4, 0, 0, 0, 0, newYork),
+		},
+		{
+			name: "week across dst end", bucket: "week", loc: newYork,
+			start: time.Date(2024, 10, 28, 0, 0, 0, 0, newYork),
+			want:  time.Date(2024, 11, 4, 0, 0, 0, 0, newYork),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextSalesBucket(tt.start, tt.bucket, tt.loc); !got.Equal(tt.want) {
+				t.Fatalf("nextSalesBucket(%v, %q) = %v, want %v", tt.start, tt.bucket, got, tt.want)
+			}
+		})
+	}
+}
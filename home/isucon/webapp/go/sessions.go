@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	userSessionTTL  = 30 * 24 * time.Hour
+	ownerSessionTTL = 30 * 24 * time.Hour
+	// 椅子は人手でログインし直せないので長期間有効な資格情報にし、オーナーが失効させる
+	chairSessionTTL = 365 * 24 * time.Hour
+)
+
+// newSession
+// 新しいアクセストークンを持つセッションを作る。署名付きトークンのモードではトークン自体に主体と有効期限を持たせる
+func newSession(principalType, principalID string, ttl time.Duration) *Session {
+	now := time.Now()
+	session := &Session{
+		Token:         secureRandomStr(32),
+		PrincipalType: principalType,
+		PrincipalID:   principalID,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+	if signer != nil {
+		session.Token = signer.Issue(session, ulid.Make().String())
+	}
+	return session
+}
+
+// insertSession
+// セッションを sessions に保存する。SessionMap への反映はコミット後に呼び出し側で行う
+func insertSession(ctx context.Context, execer sqlx.ExecerContext, session *Session) error {
+	_, err := execer.ExecContext(
+		ctx,
+		"INSERT INTO sessions (token, principal_type, principal_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		session.Token, session.PrincipalType, session.PrincipalID, session.CreatedAt, session.ExpiresAt,
+	)
+	return err
+}
+
+// revokeSession
+// 1つのセッションを失効させる
+func revokeSession(ctx context.Context, token string) error {
+	revocations := &tokenRevocations{}
+	if err := revocations.revoke(ctx, db, token); err != nil {
+		return err
+	}
+	revocations.Apply()
+	if _, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", token); err != nil {
+		return err
+	}
+	InvalidateSession(token)
+	return nil
+}
+
+// revokePrincipalSessions
+// 利用者・オーナー・椅子のすべてのセッションを失効させる
+func revokePrincipalSessions(ctx context.Context, principalType, principalID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	revocations := &tokenRevocations{}
+	if err := deletePrincipalSessions(ctx, tx, revocations, principalType, principalID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	revocations.Apply()
+	InvalidatePrincipalSessions(principalType, principalID)
+	return nil
+}
+
+// deletePrincipalSessions
+// 主体のセッションを sessions から削除し、署名付きトークンは revocations に溜める。コミット後に revocations.Apply を呼ぶこと
+func deletePrincipalSessions(ctx context.Context, tx *sqlx.Tx, revocations *tokenRevocations, principalType, principalID string) error {
+	if signer != nil {
+		tokens := []string{}
+		if err := tx.SelectContext(ctx, &tokens, "SELECT token FROM sessions WHERE principal_type = ? AND principal_id = ?", principalType, principalID); err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if err := revocations.revoke(ctx, tx, token); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE principal_type = ? AND principal_id = ?", principalType, principalID)
+	return err
+}
+
+// rotateSession
+// 現在のセッションを失効させ、同じ主体の新しいセッションを発行する
+func rotateSession(ctx context.Context, current *Session, ttl time.Duration) (*Session, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	revocations := &tokenRevocations{}
+	if err := revocations.revoke(ctx, tx, current.Token); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", current.Token); err != nil {
+		return nil, err
+	}
+	session := newSession(current.PrincipalType, current.PrincipalID, ttl)
+	if err := insertSession(ctx, tx, session); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	revocations.Apply()
+	InvalidateSession(current.Token)
+	StoreSession(session)
+	return session, nil
+}
+
+// sessionFromCookie
+// Cookie のアクセストークンに対応する有効なセッションを取得する
+func sessionFromCookie(r *http.Request, cookieName string) *Session {
+	c, err := r.Cookie(cookieName)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	return resolveSession(c.Value)
+}
+
+// TLS 終端の nginx から転送されたリクエストも HTTPS とみなす
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, cookieName string, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     cookieName,
+		Value:    session.Token,
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request, cookieName string) {
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     cookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionHandlers
+// Cookie 名と主体の種類ごとのログアウト・全端末ログアウト・トークン更新のハンドラ
+type sessionHandlers struct {
+	cookieName string
+	role       Role
+	ttl        time.Duration
+}
+
+var (
+	appSessionHandlers   = sessionHandlers{cookieName: sessionCookieNames[RoleUser], role: RoleUser, ttl: userSessionTTL}
+	ownerSessionHandlers = sessionHandlers{cookieName: sessionCookieNames[RoleOwner], role: RoleOwner, ttl: ownerSessionTTL}
+)
+
+func (h sessionHandlers) postLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := sessionFromCookie(r, h.cookieName)
+	if session == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := revokeSession(ctx, session.Token); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	clearSessionCookie(w, r, h.cookieName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h sessionHandlers) postLogoutAll(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := sessionFromCookie(r, h.cookieName)
+	if session == nil || session.PrincipalType != string(h.role) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := revokePrincipalSessions(ctx, string(h.role), session.PrincipalID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	clearSessionCookie(w, r, h.cookieName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h sessionHandlers) postRefresh(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := sessionFromCookie(r, h.cookieName)
+	if session == nil || session.PrincipalType != string(h.role) {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		return
+	}
+	rotated, err := rotateSession(ctx, session, h.ttl)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	setSessionCookie(w, r, h.cookieName, rotated)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// commission_rates にオーナーやモデルの設定が無いときのプラットフォームの手数料率(%)
+const defaultCommissionRate = 20
+
+// rideSettlement
+// ライド1件の精算。クーポンの割引はプラットフォームが負担するので、オーナーへの支払いは割引前の運賃から手数料を引いた額になる
+type rideSettlement struct {
+	Sale           int
+	Discount       int
+	CommissionRate int
+	Commission     int
+	Payout         int
+}
+
+// settleRide
+// 割引前の運賃と利用者に請求した運賃から精算額を計算する
+func settleRide(sale, fare, commissionRate int) rideSettlement {
+	commission := sale * commissionRate / 100
+	return rideSettlement{
+		Sale:           sale,
+		Discount:       max(sale-fare, 0),
+		CommissionRate: commissionRate,
+		Commission:     commission,
+		Payout:         sale - commission,
+	}
+}
+
+// getCommissionRate
+// 手数料率をオーナー、モデル、既定値の順に決める
+func getCommissionRate(ctx context.Context, q sqlx.QueryerContext, ownerID, model string) (int, error) {
+	var rate int
+	err := sqlx.GetContext(ctx, q, &rate, `SELECT rate
+FROM commission_rates
+WHERE (scope = 'owner' AND scope_key = ?)
+   OR (scope = 'model' AND scope_key = ?)
+ORDER BY scope = 'owner' DESC
+LIMIT 1`, ownerID, model)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultCommissionRate, nil
+	}
+	return rate, err
+}
+
+// salesBreakdown
+// 売上(割引前の運賃)と、プラットフォームが負担した割引額・手数料・オーナーへの支払額
+type salesBreakdown struct {
+	Sales      int `json:"sales" db:"sales"`
+	Discount   int `json:"discount" db:"discount"`
+	Commission int `json:"commission" db:"commission"`
+	Payout     int `json:"payout" db:"payout"`
+}
+
+func (b *salesBreakdown) add(other salesBreakdown) {
+	b.Sales += other.Sales
+	b.Discount += other.Discount
+	b.Commission += other.Commission
+	b.Payout += other.Payout
+}
+
+type ownerGetStatementResponse struct {
+	Month string                  `json:"month"`
+	Total salesBreakdown          `json:"total"`
+	Rides []ownerGetStatementRide `json:"rides"`
+}
+
+type ownerGetStatementRide struct {
+	RideID         string `json:"ride_id"`
+	ChairID        string `json:"chair_id"`
+	ChairName      string `json:"chair_name"`
+	Model          string `json:"model"`
+	CompletedAt    int64  `json:"completed_at"`
+	CommissionRate int    `json:"commission_rate"`
+	salesBreakdown
+}
+
+type statementRide struct {
+	RideID         string    `db:"ride_id"`
+	ChairID        string    `db:"chair_id"`
+	ChairName      string    `db:"chair_name"`
+	Model          string    `db:"model"`
+	CompletedAt    time.Time `db:"completed_at"`
+	CommissionRate int       `db:"commission_rate"`
+	salesBreakdown
+}
+
+// オーナーの月次明細。指定した月(UTC)にオーナーの椅子として完了したライドごとの精算額を返す
+func ownerGetStatement(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner, ok := requireOwner(w, r)
+	if !ok {
+		return
+	}
+
+	month, err := time.Parse("2006-01", r.PathValue("month"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("month must be formatted as YYYY-MM: %s", r.PathValue("month")))
+		return
+	}
+
+	rides := []statementRide{}
+	if err := db.SelectContext(ctx, &rides, `SELECT rides.id          AS ride_id,
+       chairs.id         AS chair_id,
+       chairs.name       AS chair_name,
+       rides.model,
+       rides.completed_at,
+       rides.commission_rate,
+       rides.sale        AS sales,
+       rides.discount,
+       rides.commission,
+       rides.payout
+FROM rides
+         JOIN chairs ON chairs.id = rides.chair_id
+WHERE rides.owner_id = ?
+  AND rides.completed_at >= ?
+  AND rides.completed_at < ?
+ORDER BY rides.completed_at, rides.id`, owner.ID, month, month.AddDate(0, 1, 0)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetStatementResponse{
+		Month: month.Format("2006-01"),
+		Rides: make([]ownerGetStatementRide, 0, len(rides)),
+	}
+	for _, ride := range rides {
+		res.Total.add(ride.salesBreakdown)
+		res.Rides = append(res.Rides, ownerGetStatementRide{
+			RideID:         ride.RideID,
+			ChairID:        ride.ChairID,
+			ChairName:      ride.ChairName,
+			Model:          ride.Model,
+			CompletedAt:    ride.CompletedAt.UnixMilli(),
+			CommissionRate: ride.CommissionRate,
+			salesBreakdown: ride.salesBreakdown,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
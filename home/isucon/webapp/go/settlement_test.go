@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestSettleRide(t *testing.T) {
+	tests := []struct {
+		name           string
+		sale           int
+		fare           int
+		commissionRate int
+		want           rideSettlement
+	}{
+		{
+			name: "no discount", sale: 1000, fare: 1000, commissionRate: 20,
+			want: rideSettlement{Sale: 1000, Discount: 0, CommissionRate: 20, Commission: 200, Payout: 800},
+		},
+		{
+			name: "coupon is borne by the platform", sale: 1000, fare: 700, commissionRate: 20,
+			want: rideSettlement{Sale: 1000, Discount: 300, CommissionRate: 20, Commission: 200, Payout: 800},
+		},
+		{
+			name: "commission rounds down", sale: 999, fare: 999, commissionRate: 15,
+			want: rideSettlement{Sale: 999, Discount: 0, CommissionRate: 15, Commission: 149, Payout: 850},
+		},
+		{
+			name: "fare above sale is not a negative discount", sale: 500, fare: 600, commissionRate: 10,
+			want: rideSettlement{Sale: 500, Discount: 0, CommissionRate: 10, Commission: 50, Payout: 450},
+		},
+		{
+			name: "no commission", sale: 1200, fare: 0, commissionRate: 0,
+			want: rideSettlement{Sale: 1200, Discount: 1200, CommissionRate: 0, Commission: 0, Payout: 1200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := settleRide(tt.sale, tt.fare, tt.commissionRate); got != tt.want {
+				t.Fatalf("settleRide(%d, %d, %d) = %+v, want %+v", tt.sale, tt.fare, tt.commissionRate, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 署名付きトークンのバージョン。形式を変えたときに古いトークンを区別するために使う
+const signedTokenVersion = "v1"
+
+// revoked_tokens を読み直して他のサーバーで失効させたトークンを反映する間隔
+const revokedTokensReloadInterval = 10 * time.Second
+
+var errInvalidSignedToken = errors.New("invalid signed token")
+
+// signedTokenClaims
+// トークンに含める主体の種類・ID・有効期限など。トークン長を抑えるため JSON のキーは短くする
+type signedTokenClaims struct {
+	KeyID         string `json:"kid"`
+	PrincipalType string `json:"typ"`
+	PrincipalID   string `json:"sub"`
+	IssuedAt      int64  `json:"iat"`
+	ExpiresAt     int64  `json:"exp"`
+	TokenID       string `json:"jti"`
+}
+
+// tokenSigner
+// 署名鍵を鍵IDごとに持つ。署名には activeKeyID の鍵を使い、検証には全ての鍵を使うので鍵をローテーションできる
+type tokenSigner struct {
+	keys        map[string][]byte
+	activeKeyID string
+}
+
+// nil のときは DB に保存したアクセストークンで認証する
+var signer *tokenSigner
+
+// revokedTokenSet
+// 失効させた署名付きトークンの jti と有効期限。読み直すときは作り直した map を丸ごと差し替えるので、途中の空の状態は見えない
+type revokedTokenSet struct {
+	mu    sync.RWMutex
+	byJTI map[string]time.Time
+}
+
+var revokedTokens = &revokedTokenSet{byJTI: map[string]time.Time{}}
+
+// 失効済みの jti かどうか
+func (s *revokedTokenSet) Has(jti string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.byJTI[jti]
+	return ok
+}
+
+// コミットした失効を1件載せる
+func (s *revokedTokenSet) Add(jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byJTI[jti] = expiresAt
+}
+
+// Replace
+// DB から読み直した失効リストに差し替える
+// 読み込んでいる間にコミットされた失効を取りこぼさないように、今の map にあってまだ期限内のものは引き継ぐ
+func (s *revokedTokenSet) Replace(byJTI map[string]time.Time, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for jti, expiresAt := range s.byJTI {
+		if _, ok := byJTI[jti]; !ok && expiresAt.After(now) {
+			byJTI[jti] = expiresAt
+		}
+	}
+	s.byJTI = byJTI
+}
+
+// tokenRevocations
+// トランザクションの中で失効させた署名付きトークン。ロールバックされた失効をメモリに載せないように、コミットした後に Apply で反映する
+type tokenRevocations struct {
+	tokens []RevokedToken
+}
+
+// revoke
+// 署名付きトークンを有効期限より前に失効させ、revoked_tokens に書き込む。DB に保存したアクセストークンのモードでは何もしない
+func (v *tokenRevocations) revoke(ctx context.Context, execer sqlx.ExecerContext, token string) error {
+	if signer == nil {
+		return nil
+	}
+	_, _, claims, err := signer.parse(token)
+	if err != nil {
+		return nil
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if _, err := execer.ExecContext(
+		ctx,
+		"INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at = VALUES(expires_at)",
+		claims.TokenID, expiresAt,
+	); err != nil {
+		return err
+	}
+	v.tokens = append(v.tokens, RevokedToken{JTI: claims.TokenID, ExpiresAt: expiresAt})
+	return nil
+}
+
+// Apply
+// 溜めた失効を失効リストに反映する。トランザクションのコミット後に呼ぶ
+func (v *tokenRevocations) Apply() {
+	for _, t := range v.tokens {
+		revokedTokens.Add(t.JTI, t.ExpiresAt)
+	}
+}
+
+// loadTokenSigner
+// ISUCON_TOKEN_MODE=signed のときだけ ISUCON_TOKEN_KEYS(kid:secret をカンマ区切り) と ISUCON_TOKEN_KEY_ID から署名鍵を読み込む
+func loadTokenSigner() (*tokenSigner, error) {
+	if os.Getenv("ISUCON_TOKEN_MODE") != "signed" {
+		return nil, nil
+	}
+
+	s := &tokenSigner{keys: map[string][]byte{}}
+	for _, entry := range strings.Split(os.Getenv("ISUCON_TOKEN_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("malformed entry in ISUCON_TOKEN_KEYS: %q", entry)
+		}
+		s.keys[kid] = []byte(secret)
+	}
+	s.activeKeyID = os.Getenv("ISUCON_TOKEN_KEY_ID")
+	if _, ok := s.keys[s.activeKeyID]; !ok {
+		return nil, fmt.Errorf("ISUCON_TOKEN_KEY_ID %q is not found in ISUCON_TOKEN_KEYS", s.activeKeyID)
+	}
+	return s, nil
+}
+
+func (s *tokenSigner) sign(keyID, payload string) string {
+	mac := hmac.New(sha256.New, s.keys[keyID])
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue
+// セッションの内容を持つ署名付きトークンを作る
+func (s *tokenSigner) Issue(session *Session, tokenID string) string {
+	claims, _ := json.Marshal(signedTokenClaims{
+		KeyID:         s.activeKeyID,
+		PrincipalType: session.PrincipalType,
+		PrincipalID:   session.PrincipalID,
+		IssuedAt:      session.CreatedAt.Unix(),
+		ExpiresAt:     session.ExpiresAt.Unix(),
+		TokenID:       tokenID,
+	})
+	payload := signedTokenVersion + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + s.sign(s.activeKeyID, payload)
+}
+
+// parse
+// 署名を検証せずにクレームを取り出す
+func (s *tokenSigner) parse(token string) (payload, signature string, claims *signedTokenClaims, err error) {
+	version, rest, ok := strings.Cut(token, ".")
+	if !ok || version != signedTokenVersion {
+		return "", "", nil, errInvalidSignedToken
+	}
+	encodedClaims, signature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return "", "", nil, errInvalidSignedToken
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(encodedClaims)
+	if err != nil {
+		return "", "", nil, errInvalidSignedToken
+	}
+	claims = &signedTokenClaims{}
+	if err := json.Unmarshal(buf, claims); err != nil {
+		return "", "", nil, errInvalidSignedToken
+	}
+	return version + "." + encodedClaims, signature, claims, nil
+}
+
+// Verify
+// 署名・有効期限・失効リストを確認し、DB を引かずにセッションを復元する
+func (s *tokenSigner) Verify(token string) (*Session, error) {
+	payload, signature, claims, err := s.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.keys[claims.KeyID]; !ok {
+		return nil, errInvalidSignedToken
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(claims.KeyID, payload))) {
+		return nil, errInvalidSignedToken
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !expiresAt.After(time.Now()) {
+		return nil, errInvalidSignedToken
+	}
+	if revokedTokens.Has(claims.TokenID) {
+		return nil, errInvalidSignedToken
+	}
+	return &Session{
+		Token:         token,
+		PrincipalType: claims.PrincipalType,
+		PrincipalID:   claims.PrincipalID,
+		CreatedAt:     time.Unix(claims.IssuedAt, 0),
+		ExpiresAt:     expiresAt,
+	}, nil
+}
+
+// resolveSession
+// アクセストークンから有効なセッションを取得する。署名付きトークンのモードでは署名の検証だけで済ませる
+func resolveSession(accessToken string) *Session {
+	if signer == nil {
+		return GetSession(accessToken)
+	}
+	session, err := signer.Verify(accessToken)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// loadRevokedTokens
+// 有効期限内の失効済みトークンを読み込み直し、期限切れのものは削除する
+func loadRevokedTokens(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at <= NOW(6)"); err != nil {
+		return err
+	}
+	rows := []RevokedToken{}
+	if err := db.SelectContext(ctx, &rows, "SELECT * FROM revoked_tokens"); err != nil {
+		return err
+	}
+
+	byJTI := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		byJTI[row.JTI] = row.ExpiresAt
+	}
+	revokedTokens.Replace(byJTI, time.Now())
+	return nil
+}
+
+// 複数台構成でも失効が伝わるように revoked_tokens を定期的に読み直す
+func watchRevokedTokens() {
+	ticker := time.NewTicker(revokedTokensReloadInterval)
+	for range ticker.C {
+		if err := loadRevokedTokens(context.Background()); err != nil {
+			slog.Error("failed to reload revoked tokens", "error", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenSigner(activeKeyID string) *tokenSigner {
+	return &tokenSigner{
+		keys: map[string][]byte{
+			"k1": []byte("secret1"),
+			"k2": []byte("secret2"),
+		},
+		activeKeyID: activeKeyID,
+	}
+}
+
+func newTestSession(ttl time.Duration) *Session {
+	now := time.Now().Truncate(time.Second)
+	return &Session{
+		PrincipalType: string(RoleChair),
+		PrincipalID:   "chair1",
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+}
+
+// テストの間だけ失効リストを差し替える
+func useRevokedTokens(t *testing.T, byJTI map[string]time.Time) {
+	t.Helper()
+	saved := revokedTokens
+	revokedTokens = &revokedTokenSet{byJTI: byJTI}
+	t.Cleanup(func() { revokedTokens = saved })
+}
+
+// 書き込みを数えるだけの ExecerContext
+type countingExecer struct {
+	execs int
+}
+
+func (e *countingExecer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	e.execs++
+	return nil, nil
+}
+
+func TestTokenSignerVerify(t *testing.T) {
+	s := newTestTokenSigner("k2")
+	valid := s.Issue(newTestSession(time.Hour), "jti-valid")
+	revoked := s.Issue(newTestSession(time.Hour), "jti-revoked")
+	useRevokedTokens(t, map[string]time.Time{"jti-revoked": time.Now().Add(time.Hour)})
+
+	version, rest, _ := strings.Cut(valid, ".")
+	claims, signature, _ := strings.Cut(rest, ".")
+
+	tests := []struct {
+		name   string
+		signer *tokenSigner
+		token  string
+		ok     bool
+	}{
+		{name: "valid", signer: s, token: valid, ok: true},
+		{name: "signed with a key that has been rotated out of use", signer: s, token: newTestTokenSigner("k1").Issue(newTestSession(time.Hour), "jti-old-key"), ok: true},
+		{name: "expired", signer: s, token: s.Issue(newTestSession(-time.Second), "jti-expired")},
+		{name: "revoked", signer: s, token: revoked},
+		{name: "unknown key", signer: &tokenSigner{keys: map[string][]byte{"k1": []byte("secret1")}, activeKeyID: "k1"}, token: valid},
+		{name: "tampered signature", signer: s, token: version + "." + claims + "." + strings.Repeat("A", len(signature))},
+		{name: "tampered claims", signer: s, token: version + "." + claims + "x." + signature},
+		{name: "unknown version", signer: s, token: "v0." + claims + "." + signature},
+		{name: "missing signature", signer: s, token: version + "." + claims},
+		{name: "not a signed token", signer: s, token: "opaque-access-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := tt.signer.Verify(tt.token)
+			if !tt.ok {
+				if !errors.Is(err, errInvalidSignedToken) {
+					t.Fatalf("expected errInvalidSignedToken, got session=%+v err=%v", session, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if session.Token != tt.token || session.PrincipalType != string(RoleChair) || session.PrincipalID != "chair1" {
+				t.Fatalf("unexpected session: %+v", session)
+			}
+		})
+	}
+}
+
+func TestTokenSignerIssueRoundTrip(t *testing.T) {
+	s := newTestTokenSigner("k1")
+	want := newTestSession(time.Hour)
+	token := s.Issue(want, "jti1")
+
+	got, err := s.Verify(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Fatalf("times were not preserved: got %+v, want %+v", got, want)
+	}
+	_, _, claims, err := s.parse(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims.KeyID != "k1" || claims.TokenID != "jti1" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestRevokedTokenSetReplace(t *testing.T) {
+	now := time.Now()
+	set := &revokedTokenSet{byJTI: map[string]time.Time{
+		"jti-loaded":          now.Add(time.Hour),
+		"jti-committed-later": now.Add(time.Hour),
+		"jti-expired":         now.Add(-time.Second),
+	}}
+
+	// 読み直しの SELECT より後にコミットされた失効は DB から読んだ map に無い
+	set.Replace(map[string]time.Time{"jti-loaded": now.Add(time.Hour), "jti-new": now.Add(time.Hour)}, now)
+
+	for _, jti := range []string{"jti-loaded", "jti-committed-later", "jti-new"} {
+		if !set.Has(jti) {
+			t.Fatalf("%s must stay revoked after reload", jti)
+		}
+	}
+	if set.Has("jti-expired") {
+		t.Fatalf("expired revocation must be dropped on reload")
+	}
+}
+
+func TestTokenRevocationsApply(t *testing.T) {
+	saved := signer
+	signer = newTestTokenSigner("k1")
+	t.Cleanup(func() { signer = saved })
+	useRevokedTokens(t, map[string]time.Time{})
+
+	token := signer.Issue(newTestSession(time.Hour), "jti-rotated")
+	execer := &countingExecer{}
+	revocations := &tokenRevocations{}
+	if err := revocations.revoke(context.Background(), execer, token); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if execer.execs != 1 {
+		t.Fatalf("revoke must write to revoked_tokens once, got %d", execer.execs)
+	}
+
+	// コミットするまではロールバックされるかもしれないので、まだ失効させない
+	if _, err := signer.Verify(token); err != nil {
+		t.Fatalf("token was revoked before the transaction committed: %v", err)
+	}
+	revocations.Apply()
+	if _, err := signer.Verify(token); !errors.Is(err, errInvalidSignedToken) {
+		t.Fatalf("token must be revoked after Apply, got %v", err)
+	}
+}
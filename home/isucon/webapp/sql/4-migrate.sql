@@ -6,14 +6,237 @@ ALTER TABLE rides ADD INDEX IX_rides_chair_id_updated_at (chair_id, updated_at);
 ALTER TABLE rides ADD INDEX IX_rides_evaluation (evaluation);
 ALTER TABLE chairs ADD INDEX IX_chairs_access_token (access_token);
 
-DROP TABLE IF EXISTS chair_locations_minus_distance;
-CREATE TABLE chair_locations_minus_distance
+ALTER TABLE ride_statuses MODIFY status ENUM ('SCHEDULED', 'MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'WAYPOINT', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態';
+
+DROP TABLE IF EXISTS ride_waypoints;
+CREATE TABLE ride_waypoints
 (
   id         VARCHAR(26) NOT NULL,
-  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
-  distance   LONG        NOT NULL COMMENT 'マイナスされた距離',
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  seq        INTEGER     NOT NULL COMMENT '経由順',
+  latitude   INTEGER     NOT NULL COMMENT '経由地(経度)',
+  longitude  INTEGER     NOT NULL COMMENT '経由地(緯度)',
+  arrived_at DATETIME(6) NULL     COMMENT '経由地到着日時',
   PRIMARY KEY (id)
 )
-  COMMENT = '椅子のマイナスされた距離テーブル';
+  COMMENT = 'ライドの経由地テーブル';
+
+ALTER TABLE ride_waypoints ADD INDEX IX_ride_waypoints_ride_id_seq (ride_id, seq);
+
+ALTER TABLE rides ADD COLUMN scheduled_at DATETIME(6) NULL COMMENT '予約配車日時' AFTER evaluation;
+ALTER TABLE rides ADD INDEX IX_rides_user_id_scheduled_at (user_id, scheduled_at);
+
+ALTER TABLE rides ADD COLUMN pooled TINYINT(1) NOT NULL DEFAULT 0 COMMENT '相乗りを希望するかどうか' AFTER scheduled_at;
+ALTER TABLE rides ADD COLUMN pool_id VARCHAR(26) NULL COMMENT '相乗りの行程ID' AFTER pooled;
+ALTER TABLE rides ADD INDEX IX_rides_pool_id (pool_id);
+
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE sessions
+(
+  token          VARCHAR(255)                     NOT NULL COMMENT 'アクセストークン',
+  principal_type ENUM ('user', 'owner', 'chair') NOT NULL COMMENT 'セッションの主体の種類',
+  principal_id   VARCHAR(26)                      NOT NULL COMMENT 'セッションの主体のID',
+  created_at     DATETIME(6)                      NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  expires_at     DATETIME(6)                      NOT NULL COMMENT '有効期限',
+  PRIMARY KEY (token)
+)
+  COMMENT = 'セッションテーブル';
+
+ALTER TABLE sessions ADD INDEX IX_sessions_principal (principal_type, principal_id);
+
+INSERT INTO sessions (token, principal_type, principal_id, created_at, expires_at)
+SELECT access_token, 'user', id, created_at, NOW(6) + INTERVAL 30 DAY FROM users;
+INSERT INTO sessions (token, principal_type, principal_id, created_at, expires_at)
+SELECT access_token, 'owner', id, created_at, NOW(6) + INTERVAL 30 DAY FROM owners;
+INSERT INTO sessions (token, principal_type, principal_id, created_at, expires_at)
+SELECT access_token, 'chair', id, created_at, NOW(6) + INTERVAL 365 DAY FROM chairs;
+
+DROP TABLE IF EXISTS revoked_tokens;
+CREATE TABLE revoked_tokens
+(
+  jti        VARCHAR(26) NOT NULL COMMENT '署名付きトークンのID',
+  expires_at DATETIME(6) NOT NULL COMMENT 'トークンの有効期限',
+  PRIMARY KEY (jti)
+)
+  COMMENT = '失効させた署名付きトークンテーブル';
+
+DROP TABLE IF EXISTS chair_locations_minus_distance;
+DROP TABLE IF EXISTS chair_total_distances;
+CREATE TABLE chair_total_distances
+(
+  chair_id       VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  total_distance INTEGER     NOT NULL COMMENT '総移動距離',
+  updated_at     DATETIME(6) NOT NULL COMMENT '最後に位置情報を記録した日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '椅子の総移動距離テーブル';
+
+INSERT INTO chair_total_distances (chair_id, total_distance, updated_at)
+SELECT chair_id,
+       COALESCE(SUM(ABS(latitude - prev_latitude) + ABS(longitude - prev_longitude)), 0),
+       MAX(created_at)
+FROM (SELECT chair_id,
+             latitude,
+             longitude,
+             created_at,
+             LAG(latitude) OVER w  AS prev_latitude,
+             LAG(longitude) OVER w AS prev_longitude
+      FROM chair_locations
+      WINDOW w AS (PARTITION BY chair_id ORDER BY created_at, id)) AS chair_location_deltas
+GROUP BY chair_id;
+
+ALTER TABLE rides ADD COLUMN sale INTEGER NULL COMMENT '売上(割引前の運賃)' AFTER pool_id;
+ALTER TABLE rides ADD COLUMN completed_at DATETIME(6) NULL COMMENT '完了日時' AFTER sale;
+ALTER TABLE rides ADD INDEX IX_rides_chair_id_completed_at (chair_id, completed_at);
+
+-- 売上はアプリケーションの起動時に埋める
+UPDATE rides
+SET completed_at = updated_at,
+    updated_at   = updated_at
+WHERE id IN (SELECT ride_id FROM ride_statuses WHERE status = 'COMPLETED');
+
+DROP TABLE IF EXISTS sales_daily;
+CREATE TABLE sales_daily
+(
+  owner_id VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  date     DATE        NOT NULL COMMENT '完了日(UTC)',
+  chair_id VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  model    TEXT        NOT NULL COMMENT '完了時の椅子のモデル',
+  sales    BIGINT      NOT NULL COMMENT '売上',
+  rides    INTEGER     NOT NULL COMMENT '完了したライドの数',
+  PRIMARY KEY (owner_id, date, chair_id, model(64))
+)
+  COMMENT = '日ごとの売上の集計テーブル';
+
+ALTER TABLE rides ADD COLUMN discount INTEGER NULL COMMENT 'プラットフォームが負担した割引額' AFTER sale;
+ALTER TABLE rides ADD COLUMN commission_rate INTEGER NULL COMMENT '手数料率(%)' AFTER discount;
+ALTER TABLE rides ADD COLUMN commission INTEGER NULL COMMENT 'プラットフォームの手数料' AFTER commission_rate;
+ALTER TABLE rides ADD COLUMN payout INTEGER NULL COMMENT 'オーナーへの支払額' AFTER commission;
+
+ALTER TABLE sales_daily ADD COLUMN discount BIGINT NOT NULL DEFAULT 0 COMMENT 'プラットフォームが負担した割引額' AFTER sales;
+ALTER TABLE sales_daily ADD COLUMN commission BIGINT NOT NULL DEFAULT 0 COMMENT 'プラットフォームの手数料' AFTER discount;
+ALTER TABLE sales_daily ADD COLUMN payout BIGINT NOT NULL DEFAULT 0 COMMENT 'オーナーへの支払額' AFTER commission;
+
+-- 設定が無いオーナー・モデルにはアプリケーションの既定の手数料率を使う
+DROP TABLE IF EXISTS commission_rates;
+CREATE TABLE commission_rates
+(
+  scope     ENUM ('owner', 'model') NOT NULL COMMENT '手数料率を設定する対象の種類',
+  scope_key VARCHAR(255)            NOT NULL COMMENT 'オーナーIDまたはモデル名',
+  rate      INTEGER                 NOT NULL COMMENT '手数料率(%)',
+  PRIMARY KEY (scope, scope_key)
+)
+  COMMENT = '手数料率テーブル';
+
+ALTER TABLE chairs ADD COLUMN retired_at DATETIME(6) NULL COMMENT '引退日時' AFTER access_token;
+
+-- owners.chair_register_token は最初に発行したトークンとして引き継ぐ。既存のトークンの ID にはオーナーIDを使う
+DROP TABLE IF EXISTS chair_register_tokens;
+CREATE TABLE chair_register_tokens
+(
+  id                VARCHAR(26)  NOT NULL COMMENT 'トークンID',
+  owner_id          VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  token             VARCHAR(255) NOT NULL COMMENT '椅子登録トークン',
+  expires_at        DATETIME(6)  NULL COMMENT '有効期限',
+  max_chairs        INTEGER      NULL COMMENT '登録できる椅子の最大数',
+  registered_chairs INTEGER      NOT NULL DEFAULT 0 COMMENT 'このトークンで登録した椅子の数',
+  revoked_at        DATETIME(6)  NULL COMMENT '失効日時',
+  created_at        DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  PRIMARY KEY (id),
+  UNIQUE (token),
+  INDEX IX_chair_register_tokens_owner_id (owner_id)
+)
+  COMMENT = '椅子登録トークンテーブル';
+
+ALTER TABLE chairs ADD COLUMN register_token_id VARCHAR(26) NULL COMMENT '登録に使ったトークンのID' AFTER access_token;
+
+INSERT INTO chair_register_tokens (id, owner_id, token, registered_chairs, created_at)
+SELECT owners.id, owners.id, owners.chair_register_token, COUNT(chairs.id), owners.created_at
+FROM owners
+         LEFT JOIN chairs ON chairs.owner_id = owners.id
+GROUP BY owners.id, owners.chair_register_token, owners.created_at;
+UPDATE chairs SET register_token_id = owner_id;
+-- 引き継いだ後は chair_register_tokens だけを使う。古い列を残すと失効やローテーションが反映されないトークンが残るので削除する
+ALTER TABLE owners DROP COLUMN chair_register_token;
+
+-- 既存のアクティブな椅子は登録したときからアクティブだったものとして扱う
+DROP TABLE IF EXISTS chair_activities;
+CREATE TABLE chair_activities
+(
+  id         VARCHAR(26) NOT NULL COMMENT 'ID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  is_active  TINYINT(1)  NOT NULL COMMENT '変更後のアクティブ状態',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '変更日時',
+  PRIMARY KEY (id),
+  INDEX IX_chair_activities_chair_id_created_at (chair_id, created_at)
+)
+  COMMENT = '椅子のアクティブ状態の変更履歴テーブル';
+
+INSERT INTO chair_activities (id, chair_id, is_active, created_at)
+SELECT id, id, TRUE, created_at FROM chairs WHERE is_active = TRUE;
+
+-- 中身はアプリケーションの起動時と初期化時に rides から作り直す
+DROP TABLE IF EXISTS chair_stats;
+CREATE TABLE chair_stats
+(
+  chair_id       VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  total_rides    INTEGER     NOT NULL DEFAULT 0 COMMENT '完了したライドの数',
+  evaluation_sum INTEGER     NOT NULL DEFAULT 0 COMMENT '評価の合計',
+  evaluation_1   INTEGER     NOT NULL DEFAULT 0 COMMENT '評価1の数',
+  evaluation_2   INTEGER     NOT NULL DEFAULT 0 COMMENT '評価2の数',
+  evaluation_3   INTEGER     NOT NULL DEFAULT 0 COMMENT '評価3の数',
+  evaluation_4   INTEGER     NOT NULL DEFAULT 0 COMMENT '評価4の数',
+  evaluation_5   INTEGER     NOT NULL DEFAULT 0 COMMENT '評価5の数',
+  updated_at     DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '椅子ごとの完了したライドと評価の集計テーブル';
+
+DROP TABLE IF EXISTS ride_feedbacks;
+CREATE TABLE ride_feedbacks
+(
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  evaluation INTEGER     NOT NULL COMMENT '評価',
+  comment    TEXT        NULL COMMENT 'コメント',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '評価日時',
+  PRIMARY KEY (ride_id),
+  INDEX IX_ride_feedbacks_chair_id_created_at (chair_id, created_at)
+)
+  COMMENT = 'ライドの評価に付けられたフィードバックテーブル';
+
+DROP TABLE IF EXISTS ride_feedback_tags;
+CREATE TABLE ride_feedback_tags
+(
+  ride_id    VARCHAR(26)                                     NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26)                                     NOT NULL COMMENT '椅子ID',
+  tag        ENUM ('cleanliness', 'comfort', 'speed', 'route') NOT NULL COMMENT '評価の理由',
+  evaluation INTEGER                                         NOT NULL COMMENT '評価',
+  PRIMARY KEY (ride_id, tag),
+  INDEX IX_ride_feedback_tags_chair_id_tag (chair_id, tag)
+)
+  COMMENT = 'ライドの評価の理由テーブル';
+
+-- 椅子が譲渡されたりモデルが変わったりしても、売上は完了したときのオーナーとモデルで集計する
+ALTER TABLE rides ADD COLUMN owner_id VARCHAR(26) NULL COMMENT '完了時の椅子のオーナーID' AFTER completed_at;
+ALTER TABLE rides ADD COLUMN model TEXT NULL COMMENT '完了時の椅子のモデル' AFTER owner_id;
+ALTER TABLE rides ADD INDEX IX_rides_owner_id_completed_at (owner_id, completed_at);
+UPDATE rides
+    JOIN chairs ON chairs.id = rides.chair_id
+SET rides.owner_id   = chairs.owner_id,
+    rides.model      = chairs.model,
+    rides.updated_at = rides.updated_at
+WHERE rides.completed_at IS NOT NULL;
+
+-- キャンセルされた予約ライドをマッチングの候補から SQL で除く
+ALTER TABLE rides ADD COLUMN canceled_at DATETIME(6) NULL COMMENT 'キャンセル日時' AFTER model;
+ALTER TABLE rides ADD INDEX IX_rides_chair_id_canceled_at_scheduled_at (chair_id, canceled_at, scheduled_at);
+UPDATE rides
+    JOIN (SELECT ride_id, MIN(created_at) AS canceled_at FROM ride_statuses WHERE status = 'CANCELED' GROUP BY ride_id) canceled
+    ON canceled.ride_id = rides.id
+SET rides.canceled_at = canceled.canceled_at,
+    rides.updated_at  = rides.updated_at;
 
-ALTER TABLE chair_locations_minus_distance ADD INDEX IX_chair_locations_minus_distance_chair_id (chair_id);
+-- 椅子の受諾までの時間をマッチングで椅子が割り当てられた日時から測る
+-- それより前のライドは割り当てた日時が残っていないので NULL のままにし、受諾までの時間の集計から外す
+ALTER TABLE rides ADD COLUMN assigned_at DATETIME(6) NULL COMMENT '椅子が割り当てられた日時' AFTER canceled_at;